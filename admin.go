@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/ini.v1"
+)
+
+/* Admin authorization: named API keys with scopes */
+
+// admin API scopes
+const (
+	ScopeStatusRead     = "status:read"
+	ScopeSessionsDelete = "sessions:delete"
+	ScopeServices       = "services:manage"
+	ScopeConfigReload   = "config:reload"
+)
+
+// AdminKey : named admin API key, Hash is "sha256:<hex>" of the key
+type AdminKey struct {
+	Name   string
+	Hash   string
+	Scopes []string
+}
+
+// hashAdminKey : value to store as an admin key hash in config
+func hashAdminKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// readAdminKeys : [admin.<name>] config sections
+//
+//	[admin.ops]
+//	Hash = sha256:...
+//	Scopes = status:read, sessions:delete
+func readAdminKeys(cfg *ini.File) []AdminKey {
+	var keys []AdminKey
+	for _, section := range cfg.Sections() {
+		if !strings.HasPrefix(section.Name(), "admin.") {
+			continue
+		}
+		keys = append(keys, AdminKey{
+			Name:   strings.TrimPrefix(section.Name(), "admin."),
+			Hash:   section.Key("Hash").String(),
+			Scopes: section.Key("Scopes").Strings(","),
+		})
+	}
+	return keys
+}
+
+// adminKeys : configured keys plus the legacy plain text AdmStatusRead and
+// AdmStatusDel keys
+func adminKeys(config Config) []AdminKey {
+	// a copy: appending to config.AdminKeys could write in its backing array
+	keys := append([]AdminKey(nil), config.AdminKeys...)
+	for _, k := range config.AdmStatusRead {
+		keys = append(keys, AdminKey{Name: "AdmStatusRead", Hash: hashAdminKey(k), Scopes: []string{ScopeStatusRead}})
+	}
+	for _, k := range config.AdmStatusDel {
+		keys = append(keys, AdminKey{Name: "AdmStatusDel", Hash: hashAdminKey(k), Scopes: []string{ScopeStatusRead, ScopeSessionsDelete}})
+	}
+	return keys
+}
+
+// findAdminKey : admin key matching the SharedKey header value, nil if unknown
+func findAdminKey(key string) *AdminKey {
+	if key == "" {
+		return nil
+	}
+	hash := []byte(hashAdminKey(key))
+	for _, k := range adminKeys(*currentConfig()) {
+		if subtle.ConstantTimeCompare(hash, []byte(k.Hash)) == 1 {
+			return &k
+		}
+	}
+	return nil
+}
+
+// requestAdminKey : key from the SharedKey header, or from the basic auth
+// password for the admin console
+func requestAdminKey(c *gin.Context) string {
+	if key := c.Request.Header.Get("SharedKey"); key != "" {
+		return key
+	}
+	_, password, _ := c.Request.BasicAuth()
+	return password
+}
+
+// adminAuth : require an admin key with scope, 401 for a missing or
+// unknown key, 403 for a key without scope
+func adminAuth(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		k := findAdminKey(requestAdminKey(c))
+		if k == nil {
+			reqLog(c).Info(c.ClientIP(), " - ADMIN unauthorized [path:", c.Request.URL.Path, "]")
+			c.Header("WWW-Authenticate", `Basic realm="castestserver admin"`)
+			c.String(401, "unauthorized\n")
+			c.Abort()
+			return
+		}
+		if contains(k.Scopes, scope) == false {
+			reqLog(c).Info(c.ClientIP(), " - ADMIN forbidden [key:", k.Name, "] [path:", c.Request.URL.Path, "]")
+			c.String(403, "forbidden\n")
+			c.Abort()
+			return
+		}
+		c.Set("admin", k.Name)
+		c.Next()
+	}
+}
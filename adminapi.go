@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* JSON admin API: sessions and tickets */
+
+// TicketView : admin view of a ticket, the ticket value itself is never
+// exposed, tickets are referenced by ID
+type TicketView struct {
+	ID         string    `json:"id"`
+	Class      string    `json:"class"`
+	User       string    `json:"user"`
+	Service    string    `json:"service,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	Uses       int       `json:"uses"`
+	LongTerm   bool      `json:"longTerm"`
+	Parent     string    `json:"parent,omitempty"`
+	Services   []string  `json:"services,omitempty"`
+}
+
+// SessionView : a TGT with the tickets it issued which are still valid
+type SessionView struct {
+	TicketView
+	Tickets []TicketView `json:"tickets"`
+}
+
+// ticketID : stable public id of a ticket value
+func ticketID(value string) string {
+	if value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:8])
+}
+
+func newTicketView(t Ticket) TicketView {
+	return TicketView{
+		ID:         ticketID(t.Value),
+		Class:      t.Class,
+		User:       t.User,
+		Service:    t.Service,
+		CreatedAt:  t.CreatedAt,
+		LastUsedAt: t.LastUsedAt,
+		Uses:       t.Uses,
+		LongTerm:   t.LongTerm,
+		Parent:     ticketID(t.Parent),
+		Services:   t.Services,
+	}
+}
+
+// TicketFilter : admin list filters, zero values match everything
+type TicketFilter struct {
+	User    string
+	Class   string
+	Service string
+	MinAge  time.Duration
+	MaxAge  time.Duration
+}
+
+// Match : true when t passes every filter
+func (f TicketFilter) Match(t Ticket, now time.Time) bool {
+	age := now.Sub(t.CreatedAt)
+	switch {
+	case f.User != "" && t.User != f.User:
+		return false
+	case f.Class != "" && t.Class != f.Class:
+		return false
+	case f.Service != "" && t.Service != f.Service && contains(t.Services, f.Service) == false:
+		return false
+	case f.MinAge > 0 && age < f.MinAge:
+		return false
+	case f.MaxAge > 0 && age > f.MaxAge:
+		return false
+	}
+	return true
+}
+
+func queryInt(c *gin.Context, name string, def int) int {
+	v, err := strconv.Atoi(c.Query(name))
+	if err != nil || v < 0 {
+		return def
+	}
+	return v
+}
+
+func queryFilter(c *gin.Context) TicketFilter {
+	return TicketFilter{
+		User:    c.Query("user"),
+		Class:   c.Query("class"),
+		Service: c.Query("service"),
+		MinAge:  time.Duration(queryInt(c, "minAge", 0)) * time.Second,
+		MaxAge:  time.Duration(queryInt(c, "maxAge", 0)) * time.Second,
+	}
+}
+
+// findTGT : TGT by public id
+func findTGT(id string) *Ticket {
+	for _, t := range registry.List() {
+		if t.Class == "TGT" && ticketID(t.Value) == id {
+			return &t
+		}
+	}
+	return nil
+}
+
+// deleteSession : remove a TGT and the tickets it issued
+func deleteSession(tgt Ticket) int {
+	return registry.Expire(func(t Ticket) bool {
+		return t.Value == tgt.Value || t.Parent == tgt.Value
+	})
+}
+
+// curl -H "SharedKey: secret1" "http://localhost:8001/api/tickets?class=TGT&user=user1&offset=0&limit=50"
+// filters: user, class, service, minAge and maxAge in seconds
+func apiListTickets(c *gin.Context) {
+	f := queryFilter(c)
+	offset := queryInt(c, "offset", 0)
+	limit := queryInt(c, "limit", 50)
+	if limit == 0 || limit > 500 {
+		limit = 500
+	}
+
+	now := time.Now()
+	l := []TicketView{}
+	for _, t := range registry.List() {
+		if f.Match(t, now) {
+			l = append(l, newTicketView(t))
+		}
+	}
+	sort.Slice(l, func(i1, i2 int) bool {
+		return l[i1].CreatedAt.After(l[i2].CreatedAt)
+	})
+	total := len(l)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	c.JSON(200, gin.H{
+		"total":   total,
+		"offset":  offset,
+		"limit":   limit,
+		"tickets": l[offset:end],
+	})
+}
+
+// curl -H "SharedKey: secret1" http://localhost:8001/api/sessions/<id>
+func apiGetSession(c *gin.Context) {
+	tgt := findTGT(c.Param("id"))
+	if tgt == nil {
+		c.JSON(404, gin.H{"error": "session not found"})
+		return
+	}
+	s := SessionView{TicketView: newTicketView(*tgt), Tickets: []TicketView{}}
+	for _, t := range registry.ListByUser(tgt.User) {
+		if t.Parent == tgt.Value {
+			s.Tickets = append(s.Tickets, newTicketView(t))
+		}
+	}
+	c.JSON(200, s)
+}
+
+// curl -X DELETE -H "SharedKey: secret2" http://localhost:8001/api/sessions/<id>
+func apiDeleteSession(c *gin.Context) {
+	tgt := findTGT(c.Param("id"))
+	if tgt == nil {
+		c.JSON(404, gin.H{"error": "session not found"})
+		return
+	}
+	n := deleteSession(*tgt)
+	reqLog(c).Info(c.ClientIP(), " - Admin ", c.GetString("admin"), ": delete session of ", tgt.User)
+	audit(c, AuditEvent{Event: AuditAdminDelete, User: tgt.User, Session: ticketID(tgt.Value)})
+	c.JSON(200, gin.H{"deleted": n})
+}
+
+// curl -X DELETE -H "SharedKey: secret2" "http://localhost:8001/api/sessions?user=user1"
+// bulk delete of the sessions of a user or of the sessions which issued
+// tickets for a service
+func apiDeleteSessions(c *gin.Context) {
+	user := c.Query("user")
+	service := c.Query("service")
+	if user == "" && service == "" {
+		c.JSON(400, gin.H{"error": "user or service required"})
+		return
+	}
+	f := TicketFilter{User: user, Service: service}
+	now := time.Now()
+	sessions := map[string]bool{}
+	for _, t := range registry.List() {
+		if t.Class == "TGT" && f.Match(t, now) {
+			sessions[t.Value] = true
+		}
+	}
+	// matching sessions, the tickets they issued and any other matching ticket
+	n := registry.Expire(func(t Ticket) bool {
+		return f.Match(t, now) || sessions[t.Parent]
+	})
+	reqLog(c).Info(c.ClientIP(), " - Admin ", c.GetString("admin"), ": delete sessions [user:", user, "] [service:", service, "]")
+	audit(c, AuditEvent{Event: AuditAdminDelete, User: user, Service: service})
+	c.JSON(200, gin.H{"deleted": n})
+}
+
+func setAdmJSONApi(a *gin.RouterGroup) {
+	a.GET("/tickets", adminAuth(ScopeStatusRead), apiListTickets)
+	a.GET("/sessions/:id", adminAuth(ScopeStatusRead), apiGetSession)
+	a.DELETE("/sessions/:id", adminAuth(ScopeSessionsDelete), apiDeleteSession)
+	a.DELETE("/sessions", adminAuth(ScopeSessionsDelete), apiDeleteSessions)
+}
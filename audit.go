@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	rotatelogs "github.com/lestrrat-go/file-rotatelogs"
+)
+
+/* Audit log: authentication events as JSON lines */
+
+// audit event types
+const (
+	AuditLoginSuccess = "login_success"
+	AuditLoginFailure = "login_failure"
+	AuditTicketIssued = "st_issued"
+	AuditValidated    = "st_validated"
+	AuditInvalid      = "st_validation_failure"
+	AuditLogout       = "logout"
+	AuditAdminDelete  = "admin_delete"
+	AuditAdminUnlock  = "admin_unlock"
+	AuditLockout      = "lockout"
+	// AuditSessionExpired : expired TGT removed by the sweep or when its
+	// cookie is presented. A TGT evicted by a redis key TTL is not reported
+	AuditSessionExpired = "session_expired"
+)
+
+// AuditEvent : audit log schema, tickets are identified by ticketID hashes
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	User      string    `json:"user,omitempty"`
+	Service   string    `json:"service,omitempty"`
+	ClientIP  string    `json:"clientIp,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	Backend   string    `json:"backend,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Ticket    string    `json:"ticket,omitempty"`
+	Session   string    `json:"session,omitempty"`
+	Admin     string    `json:"admin,omitempty"`
+	RequestID string    `json:"requestId,omitempty"`
+}
+
+var (
+	auditOut   io.Writer = ioutil.Discard
+	auditMutex           = &sync.Mutex{}
+)
+
+// confAudit : audit sink, "-" for stdout, a file path rotated daily like
+// the main log, or empty to disable
+func confAudit(path string) {
+	var out io.Writer
+	switch path {
+	case "":
+		out = ioutil.Discard
+	case "-":
+		out = os.Stdout
+	default:
+		writer, err := rotatelogs.New(
+			path+".%Y%m%d%H%M",
+			rotatelogs.WithLinkName(path),
+			rotatelogs.WithMaxAge(time.Duration(24*365)*time.Hour),
+			rotatelogs.WithRotationTime(time.Duration(24)*time.Hour),
+		)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		out = writer
+	}
+	auditMutex.Lock()
+	auditOut = out
+	auditMutex.Unlock()
+}
+
+// audit : write an event, client ip, user agent and admin key name are read
+// from the request when c is not nil, and the user is kept for the access log
+func audit(c *gin.Context, e AuditEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if c != nil {
+		e.ClientIP = c.ClientIP()
+		e.UserAgent = c.Request.UserAgent()
+		e.RequestID = c.GetString("requestId")
+		if e.Admin == "" {
+			e.Admin = c.GetString("admin")
+		}
+		if e.User != "" {
+			c.Set("user", e.User)
+		}
+	}
+	if e.Event == AuditLoginSuccess || e.Event == AuditLoginFailure {
+		authHistory.Add(AuthEvent{Time: e.Time, Success: e.Event == AuditLoginSuccess, User: e.User, IP: e.ClientIP, Service: e.Service})
+	}
+
+	currentWebhooks().Send(e)
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	auditMutex.Lock()
+	auditOut.Write(append(b, '\n'))
+	auditMutex.Unlock()
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ulule/limiter"
+	"gopkg.in/yaml.v2"
+)
+
+/* Structured config: YAML file, validation, flag overrides */
+
+// FileConfig : YAML config file layout, every Config field has a place
+//
+//	listen:
+//	  port: "3004"
+//	backend:
+//	  type: ldap
+//	  ldap:
+//	    server: ldap.example.org
+type FileConfig struct {
+	Listen struct {
+		Port     string `yaml:"port"`
+		BasePath string `yaml:"basePath"`
+		// reverse proxies allowed to set X-Forwarded-For
+		TrustedProxies []string `yaml:"trustedProxies"`
+		TLS            struct {
+			Cert         string   `yaml:"cert"`
+			Key          string   `yaml:"key"`
+			MinVersion   string   `yaml:"minVersion"`
+			Ciphers      []string `yaml:"ciphers"`
+			RedirectPort string   `yaml:"redirectPort"`
+			SelfSigned   bool     `yaml:"selfSigned"`
+		} `yaml:"tls"`
+	} `yaml:"listen"`
+	Debug   bool `yaml:"debug"`
+	Backend struct {
+		Type string `yaml:"type"`
+		Ldap struct {
+			Server string `yaml:"server"`
+			Bind   string `yaml:"bind"`
+		} `yaml:"ldap"`
+	} `yaml:"backend"`
+	Secrets struct {
+		Secret     string `yaml:"secret"`
+		HashSecret string `yaml:"hashSecret"`
+		File       string `yaml:"file"`
+		// previous keys, still accepted
+		PreviousSecrets     []string `yaml:"previousSecrets"`
+		PreviousHashSecrets []string `yaml:"previousHashSecrets"`
+		Keep                int      `yaml:"keep"`
+	} `yaml:"secrets"`
+	Log struct {
+		Path      string `yaml:"path"`
+		Format    string `yaml:"format"`
+		Level     string `yaml:"level"`
+		AuditPath string `yaml:"auditPath"`
+	} `yaml:"log"`
+	Tickets struct {
+		TGT        TicketPolicyConfig `yaml:"tgt"`
+		RememberMe TicketPolicyConfig `yaml:"rememberMe"`
+		ST         TicketPolicyConfig `yaml:"st"`
+		PT         TicketPolicyConfig `yaml:"pt"`
+	} `yaml:"tickets"`
+	Registry struct {
+		Type  string `yaml:"type"`
+		Path  string `yaml:"path"`
+		Redis struct {
+			Addr     string `yaml:"addr"`
+			Password string `yaml:"password"`
+			DB       int    `yaml:"db"`
+		} `yaml:"redis"`
+	} `yaml:"registry"`
+	Lockout struct {
+		MaxUser      int `yaml:"maxUser"`
+		MaxIP        int `yaml:"maxIP"`
+		Window       int `yaml:"window"`
+		LockDuration int `yaml:"lockDuration"`
+		LockMax      int `yaml:"lockMax"`
+	} `yaml:"lockout"`
+	RateLimits struct {
+		Login    string   `yaml:"login"`
+		Validate string   `yaml:"validate"`
+		Admin    string   `yaml:"admin"`
+		Trusted  []string `yaml:"trusted"`
+	} `yaml:"rateLimits"`
+	Webhooks struct {
+		URLs      []string `yaml:"urls"`
+		Secret    string   `yaml:"secret"`
+		Events    []string `yaml:"events"`
+		QueueSize int      `yaml:"queueSize"`
+		Retries   int      `yaml:"retries"`
+	} `yaml:"webhooks"`
+	Tracing struct {
+		Exporter string `yaml:"exporter"`
+		Endpoint string `yaml:"endpoint"`
+		Insecure bool   `yaml:"insecure"`
+	} `yaml:"tracing"`
+	Admin struct {
+		StatusRead []string   `yaml:"statusRead"`
+		StatusDel  []string   `yaml:"statusDel"`
+		Keys       []AdminKey `yaml:"keys"`
+	} `yaml:"admin"`
+}
+
+// TicketPolicyConfig : validity (TGT: hours, ST/PT: seconds), idle timeout
+// in minutes and maximum uses of a ticket class
+type TicketPolicyConfig struct {
+	ValidPeriod int `yaml:"validPeriod"`
+	IdleTimeout int `yaml:"idleTimeout,omitempty"`
+	MaxUses     int `yaml:"maxUses,omitempty"`
+}
+
+// newFileConfig : YAML layout of config, used as defaults of the file
+func newFileConfig(c Config) FileConfig {
+	var f FileConfig
+	f.Listen.Port = c.Port
+	f.Listen.BasePath = c.BasePath
+	f.Listen.TrustedProxies = c.TrustedProxies
+	f.Listen.TLS.Cert = c.TLSCert
+	f.Listen.TLS.Key = c.TLSKey
+	f.Listen.TLS.MinVersion = c.TLSMinVersion
+	f.Listen.TLS.Ciphers = c.TLSCiphers
+	f.Listen.TLS.RedirectPort = c.TLSRedirectPort
+	f.Listen.TLS.SelfSigned = c.TLSSelfSigned
+	f.Debug = c.Debug
+	f.Backend.Type = c.Backend
+	f.Backend.Ldap.Server = c.LdapServer
+	f.Backend.Ldap.Bind = c.LdapBind
+	f.Secrets.Secret = c.Secret
+	f.Secrets.HashSecret = c.HashSecret
+	f.Secrets.File = c.SecretsFile
+	f.Secrets.PreviousSecrets = c.PreviousSecrets
+	f.Secrets.PreviousHashSecrets = c.PreviousHashSecrets
+	f.Secrets.Keep = c.SecretsKeep
+	f.Log.Path = c.LogPath
+	f.Log.Format = c.LogFormat
+	f.Log.Level = c.LogLevel
+	f.Log.AuditPath = c.AuditLogPath
+	f.Tickets.TGT = TicketPolicyConfig{ValidPeriod: c.TGCvalidPeriod, IdleTimeout: c.TGCidleTimeout}
+	f.Tickets.RememberMe = TicketPolicyConfig{ValidPeriod: c.RememberMeValidPeriod, IdleTimeout: c.RememberMeIdleTimeout}
+	f.Tickets.ST = TicketPolicyConfig{ValidPeriod: c.STvalidPeriod, MaxUses: c.STmaxUses}
+	f.Tickets.PT = TicketPolicyConfig{ValidPeriod: c.PTvalidPeriod, MaxUses: c.PTmaxUses}
+	f.Registry.Type = c.Registry
+	f.Registry.Path = c.RegistryPath
+	f.Registry.Redis.Addr = c.RedisAddr
+	f.Registry.Redis.Password = c.RedisPassword
+	f.Registry.Redis.DB = c.RedisDB
+	f.Lockout.MaxUser = c.FailMaxUser
+	f.Lockout.MaxIP = c.FailMaxIP
+	f.Lockout.Window = c.FailWindow
+	f.Lockout.LockDuration = c.FailLockDuration
+	f.Lockout.LockMax = c.FailLockMax
+	f.RateLimits.Login = c.RateLogin
+	f.RateLimits.Validate = c.RateValidate
+	f.RateLimits.Admin = c.RateAdmin
+	f.RateLimits.Trusted = c.RateTrusted
+	f.Webhooks.URLs = c.WebhookURLs
+	f.Webhooks.Secret = c.WebhookSecret
+	f.Webhooks.Events = c.WebhookEvents
+	f.Webhooks.QueueSize = c.WebhookQueueSize
+	f.Webhooks.Retries = c.WebhookRetries
+	f.Tracing.Exporter = c.TraceExporter
+	f.Tracing.Endpoint = c.TraceEndpoint
+	f.Tracing.Insecure = c.TraceInsecure
+	f.Admin.StatusRead = c.AdmStatusRead
+	f.Admin.StatusDel = c.AdmStatusDel
+	f.Admin.Keys = c.AdminKeys
+	return f
+}
+
+// Config : flat config of the YAML layout
+func (f FileConfig) Config() Config {
+	return Config{
+		Port:                  f.Listen.Port,
+		BasePath:              f.Listen.BasePath,
+		TrustedProxies:        f.Listen.TrustedProxies,
+		TLSCert:               f.Listen.TLS.Cert,
+		TLSKey:                f.Listen.TLS.Key,
+		TLSMinVersion:         f.Listen.TLS.MinVersion,
+		TLSCiphers:            f.Listen.TLS.Ciphers,
+		TLSRedirectPort:       f.Listen.TLS.RedirectPort,
+		TLSSelfSigned:         f.Listen.TLS.SelfSigned,
+		Debug:                 f.Debug,
+		Backend:               f.Backend.Type,
+		LdapServer:            f.Backend.Ldap.Server,
+		LdapBind:              f.Backend.Ldap.Bind,
+		Secret:                f.Secrets.Secret,
+		HashSecret:            f.Secrets.HashSecret,
+		SecretsFile:           f.Secrets.File,
+		PreviousSecrets:       f.Secrets.PreviousSecrets,
+		PreviousHashSecrets:   f.Secrets.PreviousHashSecrets,
+		SecretsKeep:           f.Secrets.Keep,
+		LogPath:               f.Log.Path,
+		LogFormat:             f.Log.Format,
+		LogLevel:              f.Log.Level,
+		AuditLogPath:          f.Log.AuditPath,
+		TGCvalidPeriod:        f.Tickets.TGT.ValidPeriod,
+		TGCidleTimeout:        f.Tickets.TGT.IdleTimeout,
+		RememberMeValidPeriod: f.Tickets.RememberMe.ValidPeriod,
+		RememberMeIdleTimeout: f.Tickets.RememberMe.IdleTimeout,
+		STvalidPeriod:         f.Tickets.ST.ValidPeriod,
+		STmaxUses:             f.Tickets.ST.MaxUses,
+		PTvalidPeriod:         f.Tickets.PT.ValidPeriod,
+		PTmaxUses:             f.Tickets.PT.MaxUses,
+		Registry:              f.Registry.Type,
+		RegistryPath:          f.Registry.Path,
+		RedisAddr:             f.Registry.Redis.Addr,
+		RedisPassword:         f.Registry.Redis.Password,
+		RedisDB:               f.Registry.Redis.DB,
+		FailMaxUser:           f.Lockout.MaxUser,
+		FailMaxIP:             f.Lockout.MaxIP,
+		FailWindow:            f.Lockout.Window,
+		FailLockDuration:      f.Lockout.LockDuration,
+		FailLockMax:           f.Lockout.LockMax,
+		RateLogin:             f.RateLimits.Login,
+		RateValidate:          f.RateLimits.Validate,
+		RateAdmin:             f.RateLimits.Admin,
+		RateTrusted:           f.RateLimits.Trusted,
+		WebhookURLs:           f.Webhooks.URLs,
+		WebhookSecret:         f.Webhooks.Secret,
+		WebhookEvents:         f.Webhooks.Events,
+		WebhookQueueSize:      f.Webhooks.QueueSize,
+		WebhookRetries:        f.Webhooks.Retries,
+		TraceExporter:         f.Tracing.Exporter,
+		TraceEndpoint:         f.Tracing.Endpoint,
+		TraceInsecure:         f.Tracing.Insecure,
+		AdmStatusRead:         f.Admin.StatusRead,
+		AdmStatusDel:          f.Admin.StatusDel,
+		AdminKeys:             f.Admin.Keys,
+	}
+}
+
+// readYAMLConf : YAML file over config, unknown keys are errors
+func readYAMLConf(config Config, file string) (Config, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return config, err
+	}
+	f := newFileConfig(config)
+	if err := yaml.UnmarshalStrict(b, &f); err != nil {
+		return config, fmt.Errorf("%s: %v", file, err)
+	}
+	return f.Config(), nil
+}
+
+// sampleSecrets : cookie keys once shipped in the sample configs, public
+var sampleSecrets = []string{"k3Xq9vLm2Rt7Wz4B", "Hn5cT8pQ2wZr6yLk9dVb3mXf7sJg4aEu"}
+
+// validateConfig : all errors of config in one message
+func validateConfig(config Config) error {
+	var errs []string
+	check := func(ok bool, format string, a ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, a...))
+		}
+	}
+
+	p, err := strconv.Atoi(strings.TrimPrefix(config.Port, ":"))
+	check(err == nil && p > 0 && p < 65536, "port <%s>: not a tcp port", config.Port)
+	check((config.TLSCert == "") == (config.TLSKey == ""), "TLSCert, TLSKey: both are required")
+	check(!(config.TLSSelfSigned && config.TLSCert != ""), "TLSSelfSigned: not with TLSCert")
+	_, ok := tlsVersions[config.TLSMinVersion]
+	check(ok, "TLSMinVersion <%s>: must be 1.2 or 1.3", config.TLSMinVersion)
+	_, err = tlsCiphers(config.TLSCiphers)
+	check(err == nil, "TLSCiphers: %v", err)
+	if config.TLSRedirectPort != "" {
+		p, err := strconv.Atoi(config.TLSRedirectPort)
+		check(err == nil && p > 0 && p < 65536, "TLSRedirectPort <%s>: not a tcp port", config.TLSRedirectPort)
+		check(tlsEnabled(config), "TLSRedirectPort: needs TLSCert or TLSSelfSigned")
+	}
+	check(contains([]string{"", "test", "ldap"}, config.Backend), "backend <%s>: must be test or ldap", config.Backend)
+	if config.Backend == "ldap" {
+		check(config.LdapServer != "", "ldap backend: server is required")
+		check(config.LdapBind != "", "ldap backend: bind is required")
+	}
+	switch len(config.Secret) {
+	case 16, 24, 32:
+	default:
+		check(false, "Secret: must be 16, 24 or 32 bytes (AES key)")
+	}
+	check(len(config.PreviousSecrets) == len(config.PreviousHashSecrets), "PreviousSecrets, PreviousHashSecrets: must have the same length")
+	for _, s := range config.PreviousSecrets {
+		check(len(s) == 16 || len(s) == 24 || len(s) == 32, "PreviousSecrets: must be 16, 24 or 32 bytes (AES key)")
+	}
+	check(config.SecretsKeep >= 1, "SecretsKeep: must be >= 1, a rotation would drop every previous key and log every user out")
+	if !config.Debug {
+		check(config.Secret != defaultConfig.Secret && !contains(sampleSecrets, config.Secret), "Secret: default or published sample value, set a random one or SecretsFile")
+		check(config.HashSecret != defaultConfig.HashSecret && !contains(sampleSecrets, config.HashSecret), "HashSecret: default or published sample value, set a random one or SecretsFile")
+		check(len(config.HashSecret) >= 32, "HashSecret: must be at least 32 bytes")
+		for _, s := range config.PreviousHashSecrets {
+			check(len(s) >= 32, "PreviousHashSecrets: must be at least 32 bytes")
+		}
+	}
+	check(contains([]string{"", "text", "json"}, config.LogFormat), "log format <%s>: must be text or json", config.LogFormat)
+	check(contains([]string{"", "debug", "info", "warn", "error"}, config.LogLevel), "log level <%s>: must be debug, info, warn or error", config.LogLevel)
+
+	check(config.TGCvalidPeriod > 0, "TGCvalidPeriod: must be > 0")
+	check(config.TGCidleTimeout >= 0, "TGCidleTimeout: must be >= 0")
+	check(config.RememberMeValidPeriod > 0, "RememberMeValidPeriod: must be > 0, the remember me cookie would be a session cookie")
+	check(config.RememberMeIdleTimeout >= 0, "RememberMeIdleTimeout: must be >= 0")
+	check(config.STvalidPeriod > 0, "STvalidPeriod: must be > 0")
+	check(config.STmaxUses >= 0, "STmaxUses: must be >= 0")
+	check(config.PTvalidPeriod > 0, "PTvalidPeriod: must be > 0")
+	check(config.PTmaxUses >= 0, "PTmaxUses: must be >= 0")
+
+	switch config.Registry {
+	case "", "memory", "redis":
+	case "bolt":
+		check(config.RegistryPath != "", "bolt registry: path is required")
+	default:
+		check(false, "registry <%s>: must be memory, bolt or redis", config.Registry)
+	}
+
+	check(config.FailMaxUser >= 0 && config.FailMaxIP >= 0, "FailMaxUser, FailMaxIP: must be >= 0")
+	check(config.FailWindow > 0, "FailWindow: must be > 0")
+	check(config.FailLockDuration > 0, "FailLockDuration: must be > 0")
+	check(config.FailLockMax >= config.FailLockDuration, "FailLockMax: must be >= FailLockDuration")
+	for name, rate := range map[string]string{"RateLogin": config.RateLogin, "RateValidate": config.RateValidate, "RateAdmin": config.RateAdmin} {
+		if rate != "" {
+			_, err := limiter.NewRateFromFormatted(rate)
+			check(err == nil, "%s <%s>: must be <limit>-<S|M|H|D>", name, rate)
+		}
+	}
+	for _, n := range config.RateTrusted {
+		check(len(parseNets([]string{n})) == 1, "RateTrusted <%s>: not an ip or CIDR", n)
+	}
+	for _, n := range config.TrustedProxies {
+		check(len(parseNets([]string{n})) == 1, "TrustedProxies <%s>: not an ip or CIDR", n)
+	}
+
+	for _, u := range config.WebhookURLs {
+		l, err := url.Parse(u)
+		check(err == nil && (l.Scheme == "http" || l.Scheme == "https") && l.Host != "", "webhook url <%s>: must be an http(s) url", u)
+	}
+	if len(config.WebhookURLs) > 0 {
+		check(config.WebhookSecret != "", "WebhookSecret: required with WebhookURLs, a signature with an empty key can be forged")
+	}
+	check(contains([]string{"", "stdout", "otlp"}, config.TraceExporter), "trace exporter <%s>: must be stdout or otlp", config.TraceExporter)
+	if config.TraceExporter == "otlp" {
+		check(config.TraceEndpoint != "", "otlp trace exporter: endpoint is required")
+	}
+
+	scopes := []string{ScopeStatusRead, ScopeSessionsDelete, ScopeServices, ScopeConfigReload}
+	for _, k := range config.AdminKeys {
+		check(k.Name != "", "admin key: name is required")
+		check(strings.HasPrefix(k.Hash, "sha256:"), "admin key <%s>: hash must be sha256:<hex>, see -hashkey", k.Name)
+		for _, s := range k.Scopes {
+			check(contains(scopes, s), "admin key <%s>: unknown scope <%s>", k.Name, s)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// confFlags : command line flags override config, config overrides the
+// flag defaults
+func confFlags(config Config) Config {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	value := func(name string, v string) string {
+		f := flag.Lookup(name)
+		if set[name] {
+			return f.Value.String()
+		}
+		if v == "" {
+			return f.DefValue
+		}
+		return v
+	}
+	config.Port = strings.TrimPrefix(value("port", config.Port), ":")
+	config.BasePath = value("basepath", config.BasePath)
+	config.Backend = value("backend", config.Backend)
+	if set["debug"] {
+		config.Debug = *debug
+	}
+	return config
+}
+
+// applyFlags : flag variables of config, at startup only: the listener
+// keeps its port and basepath until restart
+func applyFlags(config Config) {
+	*port = config.Port
+	*basePath = config.BasePath
+	*backend = config.Backend
+	*debug = config.Debug
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConf(t *testing.T, name string, content string) string {
+	dir, err := ioutil.TempDir("", "casconf")
+	assert.Nil(t, err)
+	file := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(file, []byte(content), 0600))
+	return file
+}
+
+func TestSampleConf(t *testing.T) {
+	ini, err := readConf(*currentConfig(), "confsample.ini")
+	assert.Nil(t, err, "INI sample")
+	yml, err := readConf(*currentConfig(), "confsample.yaml")
+	assert.Nil(t, err, "YAML sample")
+	assert.Equal(t, "./secrets.ini", ini.SecretsFile, "keys generated on first run")
+	assert.Equal(t, ini.SecretsFile, yml.SecretsFile)
+
+	// valid once the keys are generated, like at startup
+	dir, _ := ioutil.TempDir("", "cassecrets")
+	defer os.RemoveAll(dir)
+	ini.SecretsFile = filepath.Join(dir, "secrets.ini")
+	ini, err = readSecrets(ini, true)
+	assert.Nil(t, err)
+	assert.Nil(t, validateConfig(ini), "INI sample is valid")
+	yml.SecretsFile = ini.SecretsFile
+	yml, err = readSecrets(yml, true)
+	assert.Nil(t, err)
+	assert.Nil(t, validateConfig(yml), "YAML sample is valid")
+
+	// both samples describe the same server
+	assert.Equal(t, ini.LdapServer, yml.LdapServer)
+	assert.Equal(t, ini.TGCidleTimeout, yml.TGCidleTimeout)
+	assert.Equal(t, ini.STvalidPeriod, yml.STvalidPeriod)
+	assert.Equal(t, ini.RateTrusted, yml.RateTrusted)
+	assert.Equal(t, ini.AdmStatusDel, yml.AdmStatusDel)
+	assert.Equal(t, ini.AdminKeys, yml.AdminKeys)
+	assert.Equal(t, "ldap", yml.Backend)
+
+	// keys published in older samples are refused
+	old := defaultConfig
+	old.Debug = false
+	old.Secret, old.HashSecret = sampleSecrets[0], sampleSecrets[1]
+	err = validateConfig(old)
+	assert.NotNil(t, err, "sample keys refused")
+	assert.Contains(t, err.Error(), "HashSecret: default or published sample value")
+}
+
+func TestYAMLConf(t *testing.T) {
+	file := writeConf(t, "cas.yml", `
+tickets:
+  st:
+    validPeriod: 10
+`)
+	defer os.RemoveAll(filepath.Dir(file))
+	c, err := readConf(*currentConfig(), file)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, c.STvalidPeriod, "value from file")
+	assert.Equal(t, currentConfig().STmaxUses, c.STmaxUses, "default kept")
+	assert.Equal(t, currentConfig().TGCvalidPeriod, c.TGCvalidPeriod, "default kept")
+
+	file = writeConf(t, "cas.yaml", "tickets:\n  st:\n    validity: 10\n")
+	defer os.RemoveAll(filepath.Dir(file))
+	_, err = readConf(*currentConfig(), file)
+	assert.NotNil(t, err, "unknown key")
+	assert.Contains(t, err.Error(), "validity", "error names the key")
+}
+
+func TestINIConfError(t *testing.T) {
+	file := writeConf(t, "cas.ini", "STvalidPeriod = soon\n")
+	defer os.RemoveAll(filepath.Dir(file))
+	_, err := readConf(*currentConfig(), file)
+	assert.NotNil(t, err, "MapTo error surfaced")
+}
+
+func TestValidateConfig(t *testing.T) {
+	assert.Nil(t, validateConfig(*currentConfig()), "defaults are valid")
+
+	c := *currentConfig()
+	c.Port = "http"
+	c.Backend = "ldap"
+	c.LdapServer = ""
+	c.STvalidPeriod = 0
+	c.Registry = "mongo"
+	c.RateLogin = "10 per minute"
+	c.RateTrusted = []string{"10.0.0.0/33"}
+	c.WebhookURLs = []string{"siem.example.org"}
+	c.AdminKeys = []AdminKey{{Name: "ops", Hash: "secret", Scopes: []string{"all"}}}
+	err := validateConfig(c)
+	assert.NotNil(t, err)
+	for _, s := range []string{"port <http>", "ldap backend: server", "STvalidPeriod", "registry <mongo>",
+		"RateLogin <10 per minute>", "RateTrusted <10.0.0.0/33>", "webhook url <siem.example.org>", "WebhookSecret: required",
+		"admin key <ops>: hash", "unknown scope <all>"} {
+		assert.Contains(t, err.Error(), s)
+	}
+}
+
+func TestEnvConf(t *testing.T) {
+	secret := writeConf(t, "secret", "from-file-0123456\n")
+	defer os.RemoveAll(filepath.Dir(secret))
+	scopes := filepath.Join(filepath.Dir(secret), "scopes")
+	ioutil.WriteFile(scopes, []byte("status:read\n"), 0600)
+	env := map[string]string{
+		"CAS_LDAP_SERVER":                "ldap.env.example.org",
+		"CAS_SECRET_FILE":                secret,
+		"CAS_SECRETS_PATH":               "/run/cas/secrets.ini",
+		"CAS_ST_MAX_USES":                "2",
+		"CAS_DEBUG":                      "true",
+		"CAS_RATE_TRUSTED":               "127.0.0.1, 10.0.0.0/8",
+		"CAS_ADMIN_KEY_OPS":              hashAdminKey("ops-key"),
+		"CAS_ADMIN_KEY_OPS_SCOPES":       "status:read,sessions:delete",
+		"CAS_ADMIN_KEY_PROM_FILE":        secret,
+		"CAS_ADMIN_KEY_PROM_SCOPES_FILE": scopes,
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+	}
+	defer func() {
+		for k := range env {
+			os.Unsetenv(k)
+		}
+	}()
+
+	c, err := readEnv(*currentConfig())
+	assert.Nil(t, err)
+	assert.Equal(t, "ldap.env.example.org", c.LdapServer, "string")
+	assert.Equal(t, "from-file-0123456", c.Secret, "secret from file")
+	assert.Equal(t, "/run/cas/secrets.ini", c.SecretsFile, "secrets file path")
+	assert.Equal(t, 2, c.STmaxUses, "int")
+	assert.True(t, c.Debug, "bool")
+	assert.Equal(t, []string{"127.0.0.1", "10.0.0.0/8"}, c.RateTrusted, "list")
+	assert.Equal(t, currentConfig().HashSecret, c.HashSecret, "unset variable keeps value")
+	assert.Equal(t, []AdminKey{
+		{Name: "ops", Hash: hashAdminKey("ops-key"), Scopes: []string{ScopeStatusRead, ScopeSessionsDelete}},
+		{Name: "prom", Hash: "from-file-0123456", Scopes: []string{ScopeStatusRead}},
+	}, c.AdminKeys, "admin keys")
+
+	os.Setenv("CAS_FAIL_WINDOW", "5m")
+	defer os.Unsetenv("CAS_FAIL_WINDOW")
+	_, err = readEnv(*currentConfig())
+	assert.NotNil(t, err, "bad number")
+}
+
+func TestReload(t *testing.T) {
+	saved, savedConf := *currentConfig(), *conf
+	defer func() { confSecrets(saved); *conf = savedConf }()
+	reloadKey := AdminKey{Name: "deploy", Hash: hashAdminKey("reload-key"), Scopes: []string{ScopeConfigReload}}
+	r := withConfig(t, func(c *Config) { c.AdminKeys = []AdminKey{reloadKey} })
+	tgt := NewTicket("TGT", "", "reload", false)
+
+	file := writeConf(t, "cas.yaml", `
+tickets:
+  st:
+    validPeriod: 42
+admin:
+  keys:
+    - name: deploy
+      hash: `+reloadKey.Hash+`
+      scopes: [config:reload]
+`)
+	defer os.RemoveAll(filepath.Dir(file))
+	*conf = file
+
+	w := request(r, "POST", "/reload", "reload-key")
+	assert.Equal(t, 200, w.Code, w.Body.String())
+	assert.Equal(t, 42, currentConfig().STvalidPeriod, "config swapped")
+	assert.NotNil(t, registry.Get(tgt.Value), "tickets kept")
+
+	// requests don't hold the config across a reload
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 20; i++ {
+			request(r, "GET", "/login", "")
+		}
+		close(done)
+	}()
+	w = request(r, "POST", "/reload", "reload-key")
+	assert.Equal(t, 200, w.Code, "reload while serving")
+	<-done
+
+	// an invalid config is refused and the running one kept
+	assert.Nil(t, ioutil.WriteFile(file, []byte("tickets:\n  st:\n    validPeriod: 0\n"), 0600))
+	w = request(r, "POST", "/reload", "reload-key")
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), "STvalidPeriod", "validation error")
+	assert.Equal(t, 42, currentConfig().STvalidPeriod, "config kept")
+
+	w = request(r, "POST", "/reload", "other-key")
+	assert.Equal(t, 401, w.Code, "reload needs an admin key")
+}
+
+func TestSecrets(t *testing.T) {
+	c := defaultConfig
+	c.Debug = false
+	err := validateConfig(c)
+	assert.NotNil(t, err, "default keys refused")
+	assert.Contains(t, err.Error(), "Secret: default or published sample value")
+	assert.Contains(t, err.Error(), "HashSecret: must be at least 32 bytes")
+	c.Debug = true
+	assert.Nil(t, validateConfig(c), "default keys allowed in debug mode")
+
+	dir, _ := ioutil.TempDir("", "cassecrets")
+	defer os.RemoveAll(dir)
+	c.Debug = false
+	c.SecretsFile = filepath.Join(dir, "secrets.ini")
+	generated, err := readSecrets(c, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 32, len(generated.Secret), "generated Secret")
+	assert.Equal(t, 64, len(generated.HashSecret), "generated HashSecret")
+	assert.Nil(t, validateConfig(generated), "generated keys are valid")
+	weak := generated
+	weak.PreviousSecrets = []string{randomKey(32)}
+	weak.PreviousHashSecrets = []string{"very-secret"}
+	weak.SecretsKeep = 0
+	err = validateConfig(weak)
+	assert.NotNil(t, err, "weak previous keys refused")
+	assert.Contains(t, err.Error(), "PreviousHashSecrets: must be at least 32 bytes")
+	assert.Contains(t, err.Error(), "SecretsKeep: must be >= 1")
+	read, err := readSecrets(c, true)
+	assert.Nil(t, err)
+	assert.Equal(t, generated.Secret, read.Secret, "keys persisted")
+	assert.Equal(t, generated.HashSecret, read.HashSecret, "keys persisted")
+
+	// a reload doesn't generate keys when the file is gone
+	missing := c
+	missing.SecretsFile = filepath.Join(dir, "missing.ini")
+	_, err = readSecrets(missing, false)
+	assert.NotNil(t, err, "missing file refused on reload")
+	_, err = os.Stat(missing.SecretsFile)
+	assert.True(t, os.IsNotExist(err), "no keys written")
+
+	// keys are applied to cookies
+	defer confSecrets(*currentConfig())
+	encoded, _ := securecookie.EncodeMulti(cookieName, "TGT-1", codecs()...)
+	confSecrets(generated)
+	var value string
+	assert.NotNil(t, securecookie.DecodeMulti(cookieName, encoded, &value, codecs()...), "new keys")
+}
+
+func TestKeyRotation(t *testing.T) {
+	defer confSecrets(*currentConfig())
+	dir, _ := ioutil.TempDir("", "cassecrets")
+	defer os.RemoveAll(dir)
+	r := withConfig(t, func(c *Config) {
+		c.SecretsFile = filepath.Join(dir, "secrets.ini")
+		c.SecretsKeep = 1
+		c.AdminKeys = []AdminKey{{Name: "deploy", Hash: hashAdminKey("rotate-key"), Scopes: []string{ScopeConfigReload}}}
+		generated, err := readSecrets(*c, true)
+		assert.Nil(t, err)
+		*c = generated
+	})
+	config := *currentConfig()
+	confSecrets(config)
+
+	rotate := func() {
+		w := request(r, "POST", "/keys/rotate", "rotate-key")
+		assert.Equal(t, 200, w.Code, w.Body.String())
+	}
+	first := config.Secret
+	encoded, _ := securecookie.EncodeMulti(cookieName, "TGT-1", codecs()...)
+	rotate()
+	assert.NotEqual(t, first, currentConfig().Secret, "new key")
+	assert.Equal(t, []string{first}, currentConfig().PreviousSecrets, "previous key kept")
+	var value string
+	assert.Nil(t, securecookie.DecodeMulti(cookieName, encoded, &value, codecs()...), "old cookie accepted")
+	assert.Equal(t, "TGT-1", value)
+
+	persisted, err := readSecrets(config, false)
+	assert.Nil(t, err)
+	assert.Equal(t, currentConfig().Secret, persisted.Secret, "rotated keys persisted")
+	assert.Equal(t, currentConfig().PreviousHashSecrets, persisted.PreviousHashSecrets, "rotated keys persisted")
+
+	rotate()
+	assert.Equal(t, 1, len(currentConfig().PreviousSecrets), "SecretsKeep previous keys")
+	assert.NotNil(t, securecookie.DecodeMulti(cookieName, encoded, &value, codecs()...), "too old cookie refused")
+}
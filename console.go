@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+/* Admin console: HTML view of sessions, authentications and lockouts */
+
+// AuthEvent : a recent authentication, shown in the admin console
+type AuthEvent struct {
+	Time    time.Time
+	Success bool
+	User    string
+	IP      string
+	Service string
+}
+
+// AuthHistory : fixed size list of the latest authentications
+type AuthHistory struct {
+	mutex  sync.Mutex
+	size   int
+	events []AuthEvent
+}
+
+var authHistory = &AuthHistory{size: 50}
+
+// Add : record an event, dropping the oldest one when full
+func (h *AuthHistory) Add(e AuthEvent) {
+	h.mutex.Lock()
+	h.events = append(h.events, e)
+	if len(h.events) > h.size {
+		h.events = h.events[len(h.events)-h.size:]
+	}
+	h.mutex.Unlock()
+}
+
+// List : copy of the events, latest first
+func (h *AuthHistory) List() []AuthEvent {
+	h.mutex.Lock()
+	l := make([]AuthEvent, len(h.events))
+	for i, e := range h.events {
+		l[len(h.events)-1-i] = e
+	}
+	h.mutex.Unlock()
+	return l
+}
+
+// UserSessions : sessions of one user in the console
+type UserSessions struct {
+	User     string
+	Sessions []TicketView
+}
+
+// ServiceUsage : a service with the number of sessions which used it
+type ServiceUsage struct {
+	Service  string
+	Sessions int
+}
+
+// consoleToken : per browser session token, required by console forms,
+// from crypto/rand so it can't be predicted
+func consoleToken(c *gin.Context) string {
+	session := sessions.Default(c)
+	token, _ := session.Get("admintoken").(string)
+	if token == "" {
+		token = randomKey(32)
+		session.Set("admintoken", token)
+		session.Save()
+	}
+	return token
+}
+
+func checkConsoleToken(c *gin.Context) bool {
+	token, _ := sessions.Default(c).Get("admintoken").(string)
+	return token != "" && c.PostForm("token") == token
+}
+
+// GET /admin with basic auth, the password is an admin key
+func adminConsole(c *gin.Context) {
+	now := time.Now()
+	users := map[string]*UserSessions{}
+	services := map[string]int{}
+	counts := map[string]int{}
+	for _, t := range registry.List() {
+		counts[t.Class]++
+		if t.Class != "TGT" {
+			continue
+		}
+		u, ok := users[t.User]
+		if !ok {
+			u = &UserSessions{User: t.User}
+			users[t.User] = u
+		}
+		u.Sessions = append(u.Sessions, newTicketView(t))
+		for _, s := range t.Services {
+			services[s]++
+		}
+	}
+
+	var userList []UserSessions
+	for _, u := range users {
+		userList = append(userList, *u)
+	}
+	sort.Slice(userList, func(i1, i2 int) bool {
+		return userList[i1].User < userList[i2].User
+	})
+	var serviceList []ServiceUsage
+	for s, n := range services {
+		serviceList = append(serviceList, ServiceUsage{Service: s, Sessions: n})
+	}
+	sort.Slice(serviceList, func(i1, i2 int) bool {
+		return serviceList[i1].Service < serviceList[i2].Service
+	})
+	var locked []FailEntry
+	for _, e := range failures.List() {
+		if e.LockedUntil.After(now) {
+			locked = append(locked, e)
+		}
+	}
+
+	c.HTML(http.StatusOK, "admin.tmpl", gin.H{
+		"title":    "CAS Admin",
+		"admin":    c.GetString("admin"),
+		"token":    consoleToken(c),
+		"counts":   counts,
+		"users":    userList,
+		"services": serviceList,
+		"locked":   locked,
+		"failures": failures.List(),
+		"events":   authHistory.List(),
+	})
+}
+
+// POST /admin/kill, form: token and id of a session or user
+func adminConsoleKill(c *gin.Context) {
+	if checkConsoleToken(c) == false {
+		c.String(403, "forbidden\n")
+		return
+	}
+	if id := c.PostForm("id"); id != "" {
+		if tgt := findTGT(id); tgt != nil {
+			deleteSession(*tgt)
+			reqLog(c).Info(c.ClientIP(), " - Admin ", c.GetString("admin"), ": delete session of ", tgt.User)
+			audit(c, AuditEvent{Event: AuditAdminDelete, User: tgt.User, Session: ticketID(tgt.Value)})
+		}
+	}
+	if user := c.PostForm("user"); user != "" {
+		for _, v := range registry.ListByUser(user) {
+			registry.Delete(v.Value)
+		}
+		reqLog(c).Info(c.ClientIP(), " - Admin ", c.GetString("admin"), ": delete sessions for ", user)
+		audit(c, AuditEvent{Event: AuditAdminDelete, User: user})
+	}
+	c.Redirect(303, getLocalURL(c)+"/admin")
+}
+
+// POST /admin/unlock, form: token and key
+func adminConsoleUnlock(c *gin.Context) {
+	if checkConsoleToken(c) == false {
+		c.String(403, "forbidden\n")
+		return
+	}
+	key := c.PostForm("key")
+	if failures.Unlock(key) {
+		reqLog(c).Info(c.ClientIP(), " - Admin ", c.GetString("admin"), ": unlock ", key)
+		audit(c, AuditEvent{Event: AuditAdminUnlock, Reason: key})
+	}
+	c.Redirect(303, getLocalURL(c)+"/admin")
+}
+
+func setAdmConsole(a *gin.RouterGroup) {
+	a.GET("", adminAuth(ScopeStatusRead), adminConsole)
+	a.POST("/kill", adminAuth(ScopeSessionsDelete), adminConsoleKill)
+	a.POST("/unlock", adminAuth(ScopeSessionsDelete), adminConsoleUnlock)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* Environment: CAS_* variables over the config file, flags still win */
+
+// envPrefix : prefix of all environment variables
+const envPrefix = "CAS_"
+
+// envVars : environment variable of each config field, lists are comma
+// separated. SecretsFile is SECRETS_PATH, SECRETS_FILE would be mistaken for
+// SECRET_FILE
+func envVars(c *Config) map[string]interface{} {
+	return map[string]interface{}{
+		"PORT":                     &c.Port,
+		"BASE_PATH":                &c.BasePath,
+		"TRUSTED_PROXIES":          &c.TrustedProxies,
+		"BACKEND":                  &c.Backend,
+		"DEBUG":                    &c.Debug,
+		"TLS_CERT":                 &c.TLSCert,
+		"TLS_KEY":                  &c.TLSKey,
+		"TLS_MIN_VERSION":          &c.TLSMinVersion,
+		"TLS_CIPHERS":              &c.TLSCiphers,
+		"TLS_REDIRECT_PORT":        &c.TLSRedirectPort,
+		"TLS_SELF_SIGNED":          &c.TLSSelfSigned,
+		"SECRET":                   &c.Secret,
+		"HASH_SECRET":              &c.HashSecret,
+		"SECRETS_PATH":             &c.SecretsFile,
+		"PREVIOUS_SECRETS":         &c.PreviousSecrets,
+		"PREVIOUS_HASH_SECRETS":    &c.PreviousHashSecrets,
+		"SECRETS_KEEP":             &c.SecretsKeep,
+		"LDAP_SERVER":              &c.LdapServer,
+		"LDAP_BIND":                &c.LdapBind,
+		"LOG_PATH":                 &c.LogPath,
+		"LOG_FORMAT":               &c.LogFormat,
+		"LOG_LEVEL":                &c.LogLevel,
+		"AUDIT_LOG_PATH":           &c.AuditLogPath,
+		"TGC_VALID_PERIOD":         &c.TGCvalidPeriod,
+		"TGC_IDLE_TIMEOUT":         &c.TGCidleTimeout,
+		"REMEMBER_ME_VALID_PERIOD": &c.RememberMeValidPeriod,
+		"REMEMBER_ME_IDLE_TIMEOUT": &c.RememberMeIdleTimeout,
+		"ST_VALID_PERIOD":          &c.STvalidPeriod,
+		"ST_MAX_USES":              &c.STmaxUses,
+		"PT_VALID_PERIOD":          &c.PTvalidPeriod,
+		"PT_MAX_USES":              &c.PTmaxUses,
+		"ADM_STATUS_READ":          &c.AdmStatusRead,
+		"ADM_STATUS_DEL":           &c.AdmStatusDel,
+		"REGISTRY":                 &c.Registry,
+		"REGISTRY_PATH":            &c.RegistryPath,
+		"REDIS_ADDR":               &c.RedisAddr,
+		"REDIS_PASSWORD":           &c.RedisPassword,
+		"REDIS_DB":                 &c.RedisDB,
+		"FAIL_MAX_USER":            &c.FailMaxUser,
+		"FAIL_MAX_IP":              &c.FailMaxIP,
+		"FAIL_WINDOW":              &c.FailWindow,
+		"FAIL_LOCK_DURATION":       &c.FailLockDuration,
+		"FAIL_LOCK_MAX":            &c.FailLockMax,
+		"RATE_LOGIN":               &c.RateLogin,
+		"RATE_VALIDATE":            &c.RateValidate,
+		"RATE_ADMIN":               &c.RateAdmin,
+		"RATE_TRUSTED":             &c.RateTrusted,
+		"WEBHOOK_URLS":             &c.WebhookURLs,
+		"WEBHOOK_SECRET":           &c.WebhookSecret,
+		"WEBHOOK_EVENTS":           &c.WebhookEvents,
+		"WEBHOOK_QUEUE_SIZE":       &c.WebhookQueueSize,
+		"WEBHOOK_RETRIES":          &c.WebhookRetries,
+		"TRACE_EXPORTER":           &c.TraceExporter,
+		"TRACE_ENDPOINT":           &c.TraceEndpoint,
+		"TRACE_INSECURE":           &c.TraceInsecure,
+	}
+}
+
+// lookupEnv : value of CAS_<name>, or content of the file named by
+// CAS_<name>_FILE, ie. a mounted secret
+func lookupEnv(name string) (string, bool, error) {
+	if v, ok := os.LookupEnv(envPrefix + name); ok {
+		return v, true, nil
+	}
+	file, ok := os.LookupEnv(envPrefix + name + "_FILE")
+	if !ok {
+		return "", false, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", false, fmt.Errorf("%s%s_FILE: %v", envPrefix, name, err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), true, nil
+}
+
+// splitList : comma separated list, trimmed
+func splitList(v string) []string {
+	var l []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			l = append(l, s)
+		}
+	}
+	return l
+}
+
+// readEnv : config with the CAS_* environment variables applied.
+// Admin keys are CAS_ADMIN_KEY_<NAME>=<hash> with
+// CAS_ADMIN_KEY_<NAME>_SCOPES=<scope>,<scope>
+func readEnv(config Config) (Config, error) {
+	for name, field := range envVars(&config) {
+		v, ok, err := lookupEnv(name)
+		if err != nil {
+			return config, err
+		}
+		if !ok {
+			continue
+		}
+		switch f := field.(type) {
+		case *string:
+			*f = v
+		case *[]string:
+			*f = splitList(v)
+		case *int:
+			if *f, err = strconv.Atoi(v); err != nil {
+				return config, fmt.Errorf("%s%s: not a number <%s>", envPrefix, name, v)
+			}
+		case *bool:
+			if *f, err = strconv.ParseBool(v); err != nil {
+				return config, fmt.Errorf("%s%s: not a boolean <%s>", envPrefix, name, v)
+			}
+		}
+	}
+
+	var names []string
+	for _, e := range os.Environ() {
+		name := strings.TrimSuffix(strings.SplitN(e, "=", 2)[0], "_FILE")
+		if !strings.HasPrefix(name, envPrefix+"ADMIN_KEY_") || strings.HasSuffix(name, "_SCOPES") {
+			continue
+		}
+		name = strings.TrimPrefix(name, envPrefix)
+		if !contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		hash, _, err := lookupEnv(name)
+		if err != nil {
+			return config, err
+		}
+		scopes, _, err := lookupEnv(name + "_SCOPES")
+		if err != nil {
+			return config, err
+		}
+		config.AdminKeys = append(config.AdminKeys, AdminKey{
+			Name:   strings.ToLower(strings.TrimPrefix(name, "ADMIN_KEY_")),
+			Hash:   hash,
+			Scopes: splitList(scopes),
+		})
+	}
+	return config, nil
+}
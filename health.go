@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* Health and readiness probes */
+
+// ComponentStatus : state of one dependency in the readiness probe, the
+// error is logged only, /ready is not authenticated
+type ComponentStatus struct {
+	Status string `json:"status"`
+	err    error
+}
+
+func newComponentStatus(err error) ComponentStatus {
+	if err != nil {
+		return ComponentStatus{Status: "fail", err: err}
+	}
+	return ComponentStatus{Status: "ok"}
+}
+
+// backendCheck : reachability of the configured authentication backend
+func backendCheck(config Config) error {
+	if config.Backend == "ldap" {
+		return ldapCheck(config)
+	}
+	return nil
+}
+
+// backendCheckPeriod : /ready is not authenticated nor rate limited, a
+// backend check result is reused for this period so probes can't flood the
+// ldap server with connections
+const backendCheckPeriod = 5 * time.Second
+
+var backendStatus struct {
+	sync.Mutex
+	backend string
+	at      time.Time
+	err     error
+}
+
+// cachedBackendCheck : backendCheck at most once per backendCheckPeriod,
+// concurrent probes wait for the running check
+func cachedBackendCheck(config Config) error {
+	backendStatus.Lock()
+	defer backendStatus.Unlock()
+	backend := config.Backend + " " + config.LdapServer
+	if backendStatus.backend == backend && time.Since(backendStatus.at) < backendCheckPeriod {
+		return backendStatus.err
+	}
+	backendStatus.backend = backend
+	backendStatus.err = backendCheck(config)
+	backendStatus.at = time.Now()
+	return backendStatus.err
+}
+
+// GET /health : the process is up
+func health(c *gin.Context) {
+	c.JSON(200, gin.H{"status": "ok"})
+}
+
+// GET /ready : 503 when the authentication backend or the ticket registry
+// is not available
+func ready(c *gin.Context) {
+	config := currentConfig()
+	components := map[string]ComponentStatus{
+		"backend:" + config.Backend: newComponentStatus(cachedBackendCheck(*config)),
+		"registry":                  newComponentStatus(registry.Ping()),
+	}
+	status, code := "ok", 200
+	for name, s := range components {
+		if s.Status != "ok" {
+			log.Error("readiness check failed for ", name, ": ", s.err)
+			status, code = "fail", 503
+		}
+	}
+	c.JSON(code, gin.H{"status": status, "components": components})
+}
+
+func setHealthApi(r *gin.Engine) {
+	r.GET("/health", health)
+	r.GET("/ready", ready)
+}
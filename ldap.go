@@ -4,32 +4,62 @@ import (
 	"crypto/tls"
 	"fmt"
 	"github.com/go-ldap/ldap/v3"
+	"github.com/sirupsen/logrus"
+	"net"
+	"time"
 )
 
-func ldapValidateUser(username string, password string, config Config) bool {
-	log.Debug(fmt.Sprintf("Validate ldap User <%s> <****>", username))
+// ldapTimeout : connection and request timeout, go-ldap waits 60s by default
+const ldapTimeout = 5 * time.Second
+
+// ldapValidateUser : bind as username, l is the log entry of the request
+func ldapValidateUser(l *logrus.Entry, username string, password string, config Config) bool {
+	l.Debug(fmt.Sprintf("Validate ldap User <%s> <****>", username))
 
 	if username == "" || password == "" {
 		return false
 	}
 
-	skipVerify := false
-	if *debug {
-		skipVerify = true
-	}
-
-	conn, err := ldap.DialTLS("tcp", fmt.Sprintf("%s:%d", config.LdapServer, 636), &tls.Config{InsecureSkipVerify: skipVerify})
+	conn, err := ldapDial(config)
 	if err != nil {
-		log.Error(err)
+		l.Error(err)
 		return false
 	}
 	defer conn.Close()
 	binduser := fmt.Sprintf("uid=%s,%s", username, config.LdapBind)
 	err = conn.Bind(binduser, password)
 	if err != nil {
-		log.Debug("[", username, "] ", err)
+		l.Debug("[", username, "] ", err)
 		return false
 	}
 
 	return true
 }
+
+// ldapDial : TLS connection to the ldap server, connection and requests
+// give up after ldapTimeout
+func ldapDial(config Config) (*ldap.Conn, error) {
+	skipVerify := false
+	if config.Debug {
+		skipVerify = true
+	}
+
+	conn, err := ldap.DialURL(fmt.Sprintf("ldaps://%s:%d", config.LdapServer, 636),
+		ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}),
+		ldap.DialWithTLSConfig(&tls.Config{InsecureSkipVerify: skipVerify}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+	return conn, nil
+}
+
+// ldapCheck : ldap server reachability for the readiness probe
+func ldapCheck(config Config) error {
+	conn, err := ldapDial(config)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
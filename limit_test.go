@@ -2,24 +2,19 @@ package main
 
 import (
 	"fmt"
+	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 )
 
-func TestUserFailLimiter(t *testing.T) {
+func TestStatus(t *testing.T) {
 	var s Status
-	//fmt.Printf(" json string: %+v\n", s.ToJSONStr())
-
-	/**
-	Test unlock with counter
-	**/
-	for i := 1; i < 3; i++ {
-		s = userFailLimiter(s, 10)
-		//fmt.Printf("%+v\n", s)
-		assert.Equal(t, true, (s.Lock == false && s.Count == i), "2 fails doesn't lock")
-		time.Sleep(1 * time.Second)
-	}
+	s.User = "user1"
 
 	/**
 	Test method ToJSONStr, fonction StrToStatus
@@ -29,26 +24,132 @@ func TestUserFailLimiter(t *testing.T) {
 	o := StrToStatus(str)
 	fmt.Printf(" json to Status: %+v\n", StrToStatus(str))
 	assert.Equal(t, false, o.Lock, "convert string to object")
+	assert.Equal(t, "user1", o.User, "convert string to object")
 
 	o = StrToStatus("")
 	fmt.Printf(" json to Status: %+v\n", StrToStatus(""))
 	assert.Equal(t, false, o.Lock, "default object Lock value")
 	assert.Equal(t, int64(0), o.LastSeen, "default object LastSeen value")
 	assert.Equal(t, 0, o.Count, "default object Count value")
+}
+
+func TestFailTracker(t *testing.T) {
+	f := NewFailTracker()
+	p := LockoutPolicy{MaxFails: 3, Window: time.Minute, Duration: 10 * time.Second, MaxDuration: 25 * time.Second}
+	now := time.Now()
+
+	/**
+	Test lock after MaxFails within Window
+	**/
+	for i := 1; i < 3; i++ {
+		assert.Equal(t, time.Duration(0), f.Fail("user:u", p, now), "2 fails doesn't lock")
+	}
+	assert.Equal(t, 10*time.Second, f.Fail("user:u", p, now), "3 fails lock")
+	assert.Equal(t, 10*time.Second, f.Locked("user:u", now), "locked")
+	assert.Equal(t, time.Duration(0), f.Locked("user:u", now.Add(11*time.Second)), "lock expired")
 
 	/**
-	Test unlock && reset count, 11 sec later
+	Test exponential backoff, capped at MaxDuration
 	**/
-	fmt.Println("wait 11s ...")
-	time.Sleep(11 * time.Second)
-	for i := 1; i < 6; i++ {
-		s = userFailLimiter(s, 10)
-		fmt.Printf("%+v\n", s)
-		if i <= 3 {
-			assert.Equal(t, true, (s.Lock == false && s.Count == i), "Count reset && 3 fails doesn't lock")
-		} else {
-			assert.Equal(t, true, (s.Lock == true && s.Count == 0), "Lock && count = 0")
+	now = now.Add(11 * time.Second)
+	f.Fail("user:u", p, now)
+	f.Fail("user:u", p, now)
+	assert.Equal(t, 20*time.Second, f.Fail("user:u", p, now), "second lock doubles")
+	now = now.Add(21 * time.Second)
+	f.Fail("user:u", p, now)
+	f.Fail("user:u", p, now)
+	assert.Equal(t, 25*time.Second, f.Fail("user:u", p, now), "capped lock")
+
+	/**
+	Test count reset outside Window, manual unlock
+	**/
+	f.Fail("ip:1.2.3.4", p, now)
+	f.Fail("ip:1.2.3.4", p, now)
+	assert.Equal(t, time.Duration(0), f.Fail("ip:1.2.3.4", p, now.Add(2*time.Minute)), "old failures forgotten")
+	assert.Equal(t, 2, len(f.List()), "list entries")
+	assert.Equal(t, "user:u", f.List()[0].Key, "locked first")
+	assert.Equal(t, true, f.Unlock("user:u"), "manual unlock")
+	assert.Equal(t, time.Duration(0), f.Locked("user:u", now), "unlocked")
+	assert.Equal(t, 1, f.Collect(time.Minute, now.Add(time.Hour)), "collect stale entries")
+}
+
+func TestLockout(t *testing.T) {
+	defer func() { failures = NewFailTracker() }()
+	failures = NewFailTracker()
+	r := withConfig(t, func(c *Config) {
+		c.FailMaxUser = 3
+		c.FailMaxIP = 5
+		c.RateLogin = ""
+	})
+	login := func(ip string, username string, password string) string {
+		form := url.Values{"username": {username}, "password": {password}}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = ip + ":1234"
+		r.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	/**
+	Test one failure count for every case of a login
+	**/
+	login("192.0.2.1", "Alice", "bad")
+	login("192.0.2.2", "ALICE", "bad")
+	login("192.0.2.3", "alice", "bad")
+	assert.Contains(t, login("192.0.2.4", "alice", "alice"), "Too many errors", "user locked whatever the case")
+	assert.Contains(t, login("192.0.2.4", "aLiCe", "aLiCe"), "Too many errors", "user locked whatever the case")
+
+	/**
+	Test a locked client ip is refused even without username
+	**/
+	for i := 0; i < 5; i++ {
+		login("198.51.100.1", fmt.Sprintf("user%d", i), "bad")
+	}
+	assert.Contains(t, login("198.51.100.1", "", ""), "Too many errors", "ip locked without username")
+	assert.Contains(t, login("198.51.100.1", "bob", "bob"), "Too many errors", "ip locked")
+}
+
+func TestRateLimit(t *testing.T) {
+	r := gin.New()
+	r.SetTrustedProxies([]string{"203.0.113.1"})
+	r.GET("/limited", rateLimit("2-M", []string{"10.0.0.0/8", "192.0.2.1"}), func(c *gin.Context) {
+		c.String(200, "ok")
+	})
+	forwarded := func(ip string, xff string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/limited", nil)
+		req.RemoteAddr = ip + ":1234"
+		if xff != "" {
+			req.Header.Set("X-Forwarded-For", xff)
 		}
-		time.Sleep(1 * time.Second)
+		r.ServeHTTP(w, req)
+		return w
+	}
+	get := func(ip string) *httptest.ResponseRecorder {
+		return forwarded(ip, "")
+	}
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, 200, get("198.51.100.1").Code, "under the limit")
+	}
+	w := get("198.51.100.1")
+	assert.Equal(t, 429, w.Code, "limit reached")
+	assert.NotEqual(t, "", w.Header().Get("Retry-After"), "Retry-After header")
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, 200, get("10.1.2.3").Code, "trusted network")
+		assert.Equal(t, 200, get("192.0.2.1").Code, "trusted ip")
+	}
+
+	// X-Forwarded-For is ignored from a peer which is not a trusted proxy
+	assert.Equal(t, 429, forwarded("198.51.100.1", "10.1.2.3").Code, "spoofed trusted ip")
+	assert.Equal(t, 429, forwarded("198.51.100.1", "198.51.100.9").Code, "spoofed other ip")
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, 200, forwarded("203.0.113.1", "10.1.2.3").Code, "trusted ip behind the proxy")
+	}
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, 200, forwarded("203.0.113.1", "198.51.100.2").Code, "client behind the proxy")
 	}
+	assert.Equal(t, 429, forwarded("203.0.113.1", "198.51.100.2").Code, "client behind the proxy limited")
 }
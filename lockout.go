@@ -0,0 +1,205 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* Lockout: server side brute force protection */
+
+var failures = NewFailTracker()
+
+// LockoutPolicy : failures allowed within Window before a lockout, each
+// successive lockout doubles Duration up to MaxDuration
+type LockoutPolicy struct {
+	MaxFails    int
+	Window      time.Duration
+	Duration    time.Duration
+	MaxDuration time.Duration
+}
+
+func userLockoutPolicy() LockoutPolicy {
+	config := currentConfig()
+	return lockoutPolicy(config, config.FailMaxUser)
+}
+
+func ipLockoutPolicy() LockoutPolicy {
+	config := currentConfig()
+	return lockoutPolicy(config, config.FailMaxIP)
+}
+
+func lockoutPolicy(config *Config, maxFails int) LockoutPolicy {
+	return LockoutPolicy{
+		MaxFails:    maxFails,
+		Window:      time.Duration(config.FailWindow) * time.Second,
+		Duration:    time.Duration(config.FailLockDuration) * time.Second,
+		MaxDuration: time.Duration(config.FailLockMax) * time.Second,
+	}
+}
+
+// userKey : failure key of username, logins match case insensitive in ldap
+// so Alice and alice share one failure count
+func userKey(username string) string {
+	return "user:" + strings.ToLower(strings.TrimSpace(username))
+}
+
+// lockoutKey : failure key typed by an admin, ie. user:Alice or ip:10.0.0.1
+func lockoutKey(key string) string {
+	if strings.HasPrefix(key, "user:") {
+		return userKey(strings.TrimPrefix(key, "user:"))
+	}
+	return key
+}
+
+// lockedOut : remaining lockout of username or of the client ip, an empty
+// username checks the client ip only
+func lockedOut(username string, ip string) time.Duration {
+	now := time.Now()
+	var d time.Duration
+	if username != "" {
+		d = failures.Locked(userKey(username), now)
+	}
+	if i := failures.Locked("ip:"+ip, now); i > d {
+		d = i
+	}
+	return d
+}
+
+// authFailed : count a failed authentication for username and client ip
+func authFailed(c *gin.Context, username string) {
+	now := time.Now()
+	ip := c.ClientIP()
+	if d := failures.Fail(userKey(username), userLockoutPolicy(), now); d > 0 {
+		reqLog(c).Info(ip, " - LOCKOUT [username:", username, "] for ", d)
+		audit(c, AuditEvent{Event: AuditLockout, User: username, Reason: "user locked for " + d.String()})
+	}
+	if d := failures.Fail("ip:"+ip, ipLockoutPolicy(), now); d > 0 {
+		reqLog(c).Info(ip, " - LOCKOUT [ip:", ip, "] for ", d)
+		audit(c, AuditEvent{Event: AuditLockout, User: username, Reason: "ip locked for " + d.String()})
+	}
+}
+
+// authSucceeded : forget previous failures of username
+func authSucceeded(username string) {
+	failures.Reset(userKey(username))
+}
+
+func collectFailures() {
+	failures.Collect(time.Duration(currentConfig().FailLockMax)*time.Second, time.Now())
+}
+
+// FailEntry : failures and lockout state of one key
+type FailEntry struct {
+	Key         string    `json:"key"`
+	Count       int       `json:"count"`
+	Lockouts    int       `json:"lockouts"`
+	LastFail    time.Time `json:"lastfail"`
+	LockedUntil time.Time `json:"lockeduntil"`
+}
+
+// FailTracker : authentication failures keyed by "user:<login>" or
+// "ip:<client ip>", independent of any client side state
+type FailTracker struct {
+	mutex   sync.Mutex
+	entries map[string]*FailEntry
+}
+
+// NewFailTracker creates an empty tracker
+func NewFailTracker() *FailTracker {
+	return &FailTracker{entries: map[string]*FailEntry{}}
+}
+
+// Locked : remaining lockout time of key, 0 when not locked
+func (f *FailTracker) Locked(key string, now time.Time) time.Duration {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	e, ok := f.entries[key]
+	if !ok || !e.LockedUntil.After(now) {
+		return 0
+	}
+	return e.LockedUntil.Sub(now)
+}
+
+// Fail : record a failure for key, returns the lockout duration when this
+// failure locks key
+func (f *FailTracker) Fail(key string, p LockoutPolicy, now time.Time) time.Duration {
+	if p.MaxFails <= 0 {
+		return 0
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	e, ok := f.entries[key]
+	if !ok {
+		e = &FailEntry{Key: key}
+		f.entries[key] = e
+	}
+	if now.Sub(e.LastFail) > p.Window {
+		e.Count = 0
+	}
+	if now.Sub(e.LastFail) > p.MaxDuration {
+		e.Lockouts = 0
+	}
+	e.LastFail = now
+	e.Count++
+	if e.Count < p.MaxFails {
+		return 0
+	}
+	d := p.Duration << uint(e.Lockouts)
+	if d > p.MaxDuration || d <= 0 {
+		d = p.MaxDuration
+	}
+	e.Count = 0
+	e.Lockouts++
+	e.LockedUntil = now.Add(d)
+	return d
+}
+
+// Reset : forget failures of key after a successful authentication
+func (f *FailTracker) Reset(key string) {
+	f.mutex.Lock()
+	delete(f.entries, key)
+	f.mutex.Unlock()
+}
+
+// Unlock : manual unlock by an admin, returns false for an unknown key
+func (f *FailTracker) Unlock(key string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, ok := f.entries[key]; !ok {
+		return false
+	}
+	delete(f.entries, key)
+	return true
+}
+
+// List : copy of all entries, locked keys first
+func (f *FailTracker) List() []FailEntry {
+	f.mutex.Lock()
+	l := make([]FailEntry, 0, len(f.entries))
+	for _, e := range f.entries {
+		l = append(l, *e)
+	}
+	f.mutex.Unlock()
+	sort.Slice(l, func(i1, i2 int) bool {
+		return l[i1].LockedUntil.After(l[i2].LockedUntil)
+	})
+	return l
+}
+
+// Collect : drop entries without recent failure
+func (f *FailTracker) Collect(maxAge time.Duration, now time.Time) int {
+	n := 0
+	f.mutex.Lock()
+	for k, e := range f.entries {
+		if now.Sub(e.LastFail) > maxAge && !e.LockedUntil.After(now) {
+			delete(f.entries, k)
+			n++
+		}
+	}
+	f.mutex.Unlock()
+	return n
+}
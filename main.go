@@ -5,6 +5,8 @@ package main
 // https://github.com/apognu/gocas
 
 import (
+	"context"
+	"crypto/rand"
 	"flag"
 	"fmt"
 	"github.com/gin-contrib/location"
@@ -12,52 +14,44 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/securecookie"
 	"github.com/robfig/cron"
+	"github.com/sirupsen/logrus"
 	"html/template"
-	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"regexp"
 	"sort"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gin-contrib/sessions"
-	"github.com/gin-contrib/sessions/cookie"
 
 	"github.com/itsjamie/gin-cors"
-
-	"github.com/ulule/limiter"
-	mgin "github.com/ulule/limiter/drivers/middleware/gin"
-	"github.com/ulule/limiter/drivers/store/memory"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 const (
 	letterIdxBits = 6                    // 6 bits to represent a letter index
 	letterIdxMask = 1<<letterIdxBits - 1 // All 1-bits, as many as letterIdxBits
-	letterIdxMax  = 63 / letterIdxBits   // # of letter indices fitting in 63 bits
 )
 
-var src = rand.NewSource(time.Now().UnixNano())
-var hashKey = []byte(config.HashSecret)
-var blockKey = []byte(config.Secret)
-var secure = securecookie.New(hashKey, blockKey)
-
+// RandString : n random letters from crypto/rand, for ticket values and
+// request ids which must not be predictable
 func RandString(n int) string {
 	b := make([]byte, n)
-	// A src.Int63() generates 63 random bits, enough for letterIdxMax characters!
-	for i, cache, remain := n-1, src.Int63(), letterIdxMax; i >= 0; {
-		if remain == 0 {
-			cache, remain = src.Int63(), letterIdxMax
+	for i := 0; i < n; {
+		// about 1 random byte in 5 is out of letterBytes
+		r := make([]byte, n-i+(n-i)/4+1)
+		if _, err := rand.Read(r); err != nil {
+			panic(err)
 		}
-		if idx := int(cache & letterIdxMask); idx < len(letterBytes) {
-			b[i] = letterBytes[idx]
-			i--
+		for _, c := range r {
+			if idx := int(c & letterIdxMask); idx < len(letterBytes) && i < n {
+				b[i] = letterBytes[idx]
+				i++
+			}
 		}
-		cache >>= letterIdxBits
-		remain--
 	}
 
 	return string(b)
@@ -70,58 +64,127 @@ type Ticket struct {
 	Service   string
 	CreatedAt time.Time
 	Renew     bool
+	// expiration policy state
+	LastUsedAt time.Time
+	Uses       int
+	LongTerm   bool
+	// ST: TGT it was issued from, TGT: services it issued tickets for
+	Parent   string
+	Services []string
 }
 
 func NewTicket(class string, service string, user string, renew bool) *Ticket {
-	t := Ticket{
-		Class:     class,
-		Value:     class + "-" + RandString(32),
-		CreatedAt: time.Now(),
-		User:      user,
-		Service:   service,
-		Renew:     renew,
-	}
-	mutex.Lock()
-	tickets[t.Value] = t
-	mutex.Unlock()
+	return addTicket(context.Background(), Ticket{
+		Class:   class,
+		User:    user,
+		Service: service,
+		Renew:   renew,
+	})
+}
+
+// addTicket : set value and dates of a new ticket and store it, traced as
+// a child of the span of ctx
+func addTicket(ctx context.Context, t Ticket) *Ticket {
+	now := time.Now()
+	t.Value = t.Class + "-" + RandString(32)
+	t.CreatedAt = now
+	t.LastUsedAt = now
+	if err := traceRegistry(ctx, "add", func() error { return registry.Add(t) }); err != nil {
+		log.Error(err)
+	}
+	metricTicketsIssued.WithLabelValues(t.Class).Inc()
 	return &t
 }
 
-func GetTicket(value string) *Ticket {
-	mutex.Lock()
-	t, ok := tickets[value]
-	mutex.Unlock()
-	if ok {
-		return &t
+// recordService : remember a service a TGT issued a ticket for, in one
+// registry update so concurrent logins don't lose a service and a removed
+// TGT is not written back
+func recordService(ctx context.Context, tgt *Ticket, service string) {
+	var t *Ticket
+	err := traceRegistry(ctx, "update", func() (err error) {
+		t, err = registry.Update(tgt.Value, func(t *Ticket) {
+			if !contains(t.Services, service) {
+				t.Services = append(t.Services, service)
+			}
+		})
+		return err
+	})
+	if err != nil {
+		if err != ErrTicketNotFound {
+			log.Error(err)
+		}
+		return
 	}
-	return nil
+	*tgt = *t
+}
+
+func GetTicket(value string) *Ticket {
+	return registry.Get(value)
 }
 
 func DeleteTicket(value string) {
-	mutex.Lock()
-	delete(tickets, value)
-	mutex.Unlock()
+	registry.Delete(value)
 }
 
-func NewTGC(ctx *gin.Context, ticket *Ticket) {
-	sec := false
-	if *debug == false {
-		sec = true
+// NewTGC : new TGT and its cookie, a long term TGT ("remember me") gets a
+// persistent cookie which outlives the browser session
+func NewTGC(ctx *gin.Context, user string, service string, longTerm bool) *Ticket {
+	cookie := tgcCookie()
+	var services []string
+	if service != "" {
+		services = []string{service}
 	}
-	cookie := &http.Cookie{Name: cookieName, Path: *basePath, HttpOnly: sec, Secure: sec}
-	tgt := NewTicket("TGT", ticket.Service, ticket.User, false)
-	encodedValue, _ := secure.Encode(cookieName, tgt.Value)
+	tgt := addTicket(ctx.Request.Context(), Ticket{Class: "TGT", Service: service, User: user, LongTerm: longTerm, Services: services})
+	if longTerm {
+		cookie.MaxAge = int(ticketPolicy(*tgt).TimeToLive.Seconds())
+	}
+	encodedValue, _ := securecookie.EncodeMulti(cookieName, tgt.Value, codecs()...)
 
-	log.Debug(fmt.Sprintf("New TGC User: <%s>", ticket.User))
+	log.Debug(fmt.Sprintf("New TGC User: <%s>", user))
 	cookie.Value = encodedValue
 	http.SetCookie(ctx.Writer, cookie)
+	return tgt
 }
 
 func GetTGC(ctx *gin.Context) *Ticket {
 	payload, _ := ctx.Cookie(cookieName)
 	var decodedValue string
-	secure.Decode(cookieName, payload, &decodedValue)
-	return GetTicket(decodedValue)
+	securecookie.DecodeMulti(cookieName, payload, &decodedValue, codecs()...)
+	if decodedValue == "" {
+		return nil
+	}
+	var t *Ticket
+	traceRegistry(ctx.Request.Context(), "get", func() error {
+		t = GetTicket(decodedValue)
+		return nil
+	})
+	if t == nil {
+		return nil
+	}
+	// sliding expiration: each access extends an idle TGT
+	now := time.Now()
+	if ticketPolicy(*t).IsExpired(*t, now) {
+		log.Debug(fmt.Sprintf("Expired TGC User: <%s>", t.User))
+		traceRegistry(ctx.Request.Context(), "delete", func() error {
+			DeleteTicket(t.Value)
+			return nil
+		})
+		metricTicketsExpired.WithLabelValues(t.Class).Inc()
+		audit(ctx, AuditEvent{Event: AuditSessionExpired, User: t.User, Session: ticketID(t.Value)})
+		return nil
+	}
+	// a TGT removed meanwhile (logout, admin) is not written back
+	err := traceRegistry(ctx.Request.Context(), "update", func() (err error) {
+		t, err = registry.Update(t.Value, func(t *Ticket) { t.LastUsedAt = now })
+		return err
+	})
+	if err != nil {
+		if err != ErrTicketNotFound {
+			log.Error(err)
+		}
+		return nil
+	}
+	return t
 }
 
 func DeleteTGC(ctx *gin.Context) {
@@ -130,29 +193,63 @@ func DeleteTGC(ctx *gin.Context) {
 		DeleteTicket(ticket.Value)
 	}
 
-	cookie := &http.Cookie{Name: cookieName, Path: *basePath}
+	// same attributes as NewTGC, or the browser keeps a persistent cookie
+	cookie := tgcCookie()
 	cookie.Value = "deleted"
+	cookie.MaxAge = -1
 	http.SetCookie(ctx.Writer, cookie)
 
 	return
 }
 
+// tgcCookie : TGC cookie attributes, secure unless debug on plain http
+func tgcCookie() *http.Cookie {
+	config := currentConfig()
+	sec := false
+	if config.Debug == false || tlsEnabled(*config) {
+		sec = true
+	}
+	return &http.Cookie{Name: cookieName, Path: *basePath, HttpOnly: sec, Secure: sec}
+}
+
 var (
 	basePath   = flag.String("basepath", "", "basepath")
 	backend    = flag.String("backend", "test", "user validate : [test|ldap]")
-	tickets    = map[string]Ticket{}
 	cookieName = "CASTGC"
-	mutex      = &sync.Mutex{}
 	port       = flag.String("port", "3004", "CAS listening port")
 	debug      = flag.Bool("debug", false, "Debug, doesn't log to file")
-	conf       = flag.String("conf", "", "Optional INI config file")
-	config     = Config{
-		Port:           ":3004",
-		Secret:         "0123456789123456",
-		HashSecret:     "very-secret",
-		LdapServer:     "ldap.example.org",
-		LdapBind:       "ou=people,dc=example,dc=org",
-		TGCvalidPeriod: 4, // hours
+	conf       = flag.String("conf", "", "Optional config file, INI or YAML (.yaml, .yml)")
+	hashAdmKey = flag.String("hashkey", "", "Print the config hash of an admin key and exit")
+	// defaultConfig : compiled-in values, overridden by the config file,
+	// environment and flags
+	defaultConfig = Config{
+		Port:                  ":3004",
+		Secret:                "0123456789123456",
+		HashSecret:            "very-secret",
+		SecretsKeep:           2,
+		LdapServer:            "ldap.example.org",
+		LdapBind:              "ou=people,dc=example,dc=org",
+		TGCvalidPeriod:        4,   // hours
+		TGCidleTimeout:        0,   // minutes
+		RememberMeValidPeriod: 336, // hours
+		RememberMeIdleTimeout: 0,   // minutes
+		STvalidPeriod:         300, // seconds
+		STmaxUses:             1,
+		PTvalidPeriod:         300, // seconds
+		PTmaxUses:             1,
+		FailMaxUser:           3,
+		FailMaxIP:             20,
+		FailWindow:            300,  // seconds
+		FailLockDuration:      30,   // seconds
+		FailLockMax:           3600, // seconds
+		RateLogin:             "10-M",
+		RateValidate:          "300-M",
+		RateAdmin:             "60-M",
+		WebhookQueueSize:      100,
+		WebhookRetries:        3,
+		Registry:              "memory",
+		RegistryPath:          "./tickets.db",
+		RedisAddr:             "localhost:6379",
 	}
 	garbageCollectionPeriod = 5
 )
@@ -184,59 +281,88 @@ func init() {
 	if !strings.HasSuffix(os.Args[0], ".test") {
 		flag.Parse()
 	} else {
-		*debug = true
+		flag.Set("debug", "true")
+	}
+	// a hash needs no config: print it before loading one, or opening the
+	// registry of a running server
+	if *hashAdmKey != "" {
+		fmt.Println(hashAdminKey(*hashAdmKey))
+		os.Exit(0)
 	}
 
-	config, _ = readConf(config, *conf)
+	if *conf == "" {
+		*conf = os.Getenv(envPrefix + "CONF")
+	}
+	c, err := loadConfig(true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	setConfig(c)
+	applyFlags(c)
+	confSecrets(c)
 	if *debug {
-		fmt.Printf("%+v\n", config)
+		fmt.Printf("%+v\n", c)
+	} else {
+		gin.SetMode(gin.ReleaseMode)
 	}
 
-	confLog(config.LogPath)
+	confLog(c.LogPath, c.LogFormat, c.LogLevel, c.Debug)
+	confAudit(c.AuditLogPath)
+
+	r, err := newRegistry(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	registry = r
 
+	w := NewWebhooks(c)
+	if w != nil {
+		w.Start()
+	}
+	setWebhooks(w)
 }
 
 func main() {
+	// drop tickets which expired while the server was down
+	collectTickets()
+
 	cr := cron.New()
 	cr.AddFunc(fmt.Sprintf("@every %dm", garbageCollectionPeriod), collectTickets)
+	cr.AddFunc(fmt.Sprintf("@every %dm", garbageCollectionPeriod), collectFailures)
 	cr.Start()
 
-	setupServer().Run(":" + *port)
+	watchReload()
+
+	config := currentConfig()
+	flushTraces, err := confTracing(*config)
+	if err != nil {
+		log.Error(err)
+	}
+	defer flushTraces()
 
+	err = serve(setupServer(), *config)
 	cr.Stop()
+	if err != nil {
+		flushTraces()
+		log.Fatal(err)
+	}
 }
 
 // The engine with all endpoints is now extracted from the main function
 func setupServer() *gin.Engine {
 
-	rate, err := limiter.NewRateFromFormatted("10-M") // 10 reqs/minute
-	if err != nil {
-		panic(err)
-	}
-	lStore := memory.NewStore()
-	middleware := mgin.NewMiddleware(limiter.New(lStore, rate))
-
+	config := currentConfig()
 	r := gin.New() //Default()
-	if *debug == false {
-		r.Use(gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
-			// custom format
-			return fmt.Sprintf("%s - [%s] \"%s %s %s\" %d \"%s\" %s\n",
-				param.ClientIP,
-				param.TimeStamp.Format(time.RFC3339),
-				param.Method,
-				param.Path,
-				param.Request.Proto,
-				param.StatusCode,
-				param.Request.UserAgent(),
-				param.ErrorMessage,
-			)
-		}))
-	} else {
-		r.Use(gin.Logger())
-	}
+	r.Use(requestID())
+	r.Use(accessLogger())
 	r.Use(gin.Recovery())
+	r.Use(traceMiddleware())
+	// X-Forwarded-For is read only from TrustedProxies, anyone else could
+	// choose its client ip and escape rate limits and lockout
 	r.ForwardedByClientIP = true
-	r.Use(middleware)
+	if err := r.SetTrustedProxies(config.TrustedProxies); err != nil {
+		log.Error(err)
+	}
 
 	/*  ========================================= */
 	r.Use(cors.Middleware(cors.Config{
@@ -247,7 +373,7 @@ func setupServer() *gin.Engine {
 		ValidateHeaders: false,
 	}))
 
-	store := cookie.NewStore(blockKey)
+	store := cookieStore
 	store.Options(sessions.Options{
 		//Domain:   "localhost",
 		SameSite: http.SameSiteStrictMode,
@@ -258,11 +384,13 @@ func setupServer() *gin.Engine {
 	r.Use(location.Default())
 
 	//r.LoadHTMLGlob("tmpl/*")
-	r.HTMLRender = loadTemplates("login.tmpl")
+	r.HTMLRender = loadTemplates("login.tmpl", "admin.tmpl")
 	setApi(r)
 
 	setAdmApi(r)
 
+	setHealthApi(r)
+
 	log.Info("Server started")
 
 	//r.Run(":" + *port)
@@ -272,23 +400,21 @@ func setupServer() *gin.Engine {
 
 func collectTickets() {
 	//fmt.Printf("Cleaning tickets\n")
-	numTicketsCollected := 0
-	m5, _ := time.ParseDuration(fmt.Sprintf("%dm", garbageCollectionPeriod))
-	five := time.Now().Add(-m5)
-	tgcHours, _ := time.ParseDuration(fmt.Sprintf("%dh", config.TGCvalidPeriod))
-	tgcValid := time.Now().Add(-tgcHours)
-	mutex.Lock()
-	for k, v := range tickets {
-		if ((v.Class == "ST") || (v.Class == "LT")) && v.CreatedAt.Before(five) {
-			delete(tickets, k)
-			numTicketsCollected++
-		}
-		if (v.Class == "TGT") && v.CreatedAt.Before(tgcValid) {
-			delete(tickets, k)
-			numTicketsCollected++
+	now := time.Now()
+	var sessions []Ticket
+	numTicketsCollected := registry.Expire(func(v Ticket) bool {
+		if ticketPolicy(v).IsExpired(v, now) {
+			metricTicketsExpired.WithLabelValues(v.Class).Inc()
+			if v.Class == "TGT" {
+				sessions = append(sessions, v)
+			}
+			return true
 		}
+		return false
+	})
+	for _, v := range sessions {
+		audit(nil, AuditEvent{Event: AuditSessionExpired, User: v.User, Session: ticketID(v.Value)})
 	}
-	mutex.Unlock()
 	if numTicketsCollected > 0 {
 		log.Info(fmt.Sprintf("%d tickets cleaned", numTicketsCollected))
 		//fmt.Printf(" Tickets : %+v\n", tickets)
@@ -296,65 +422,89 @@ func collectTickets() {
 }
 
 func setApi(r *gin.Engine) {
-	r.GET("/login", login)
-	r.POST("/login", loginPost)
-	r.GET("/logout", logout)
-	r.GET("/validate", validate)               // CASv1
-	r.GET("/serviceValidate", serviceValidate) // CASv2
-	// r.GET("/p3/serviceValidate", serviceValidateV3) // CASv3
+	config := currentConfig()
+	l := r.Group("/", rateLimit(config.RateLogin, config.RateTrusted))
+	l.GET("/login", login)
+	l.POST("/login", loginPost)
+	l.GET("/logout", logout)
+
+	v := r.Group("/", rateLimit(config.RateValidate, config.RateTrusted))
+	v.GET("/validate", validate)                    // CASv1
+	v.GET("/serviceValidate", serviceValidate)      // CASv2
+	v.GET("/p3/serviceValidate", serviceValidateV3) // CASv3
 }
 
 // curl -H "SharedKey: secret1" http://localhost:8001/status
 func readStatus(c *gin.Context) {
-	auth := c.Request.Header.Get("SharedKey")
-	//fmt.Println("header:", auth)
 	c.Header("Content-Type", "text/plain")
-	if auth != "" && contains(config.AdmStatusRead, c.Request.Header.Get("SharedKey")) == true {
-		var t []Ticket
-		for _, v := range tickets {
-			t = append(t, v)
-		}
-		sort.Slice(t, func(i1, i2 int) bool {
-			return t[i1].Class > t[i2].Class
-		})
-		h := ""
-		for _, v := range t {
-			h = h + fmt.Sprintf("%s [%s]: %s %s\n", v.Class, v.CreatedAt, v.User, v.Service)
-		}
-
-		c.String(200, h)
-	} else {
-		c.String(404, "access forbiden")
+	t := registry.List()
+	sort.Slice(t, func(i1, i2 int) bool {
+		return t[i1].Class > t[i2].Class
+	})
+	h := ""
+	for _, v := range t {
+		h = h + fmt.Sprintf("%s [%s]: %s %s\n", v.Class, v.CreatedAt, v.User, v.Service)
 	}
 
+	c.String(200, h)
 }
 
-// curl -X POST -H "SharedKey: secret" http://localhost:8001/del/user1
+// curl -X POST -H "SharedKey: secret2" http://localhost:8001/del/user1
 func delStatus(c *gin.Context) {
-	auth := c.Request.Header.Get("SharedKey")
-	//fmt.Println("header:", auth)
 	c.Header("Content-Type", "text/plain")
 	user := c.Param("login")
 	msg := "no ticket for user"
-	if auth != "" && user != "" && contains(config.AdmStatusRead, c.Request.Header.Get("SharedKey")) == true {
-		mutex.Lock()
-		for k, v := range tickets {
-			if v.User == user {
-				delete(tickets, k)
-				msg = ""
-			}
+	for _, v := range registry.ListByUser(user) {
+		registry.Delete(v.Value)
+		msg = ""
+	}
+	reqLog(c).Info(c.ClientIP(), " - Admin ", c.GetString("admin"), ": delete sessions for ", user)
+	audit(c, AuditEvent{Event: AuditAdminDelete, User: user})
+	c.String(200, fmt.Sprintf("%s %s removed\n", msg, user))
+}
+
+// curl -H "SharedKey: secret1" http://localhost:8001/lockout
+func readLockout(c *gin.Context) {
+	c.Header("Content-Type", "text/plain")
+	h := ""
+	now := time.Now()
+	for _, v := range failures.List() {
+		lock := ""
+		if v.LockedUntil.After(now) {
+			lock = fmt.Sprintf(" LOCKED until %s", v.LockedUntil.Format(time.RFC3339))
 		}
-		mutex.Unlock()
-		c.String(200, fmt.Sprintf("%s %s removed\n", msg, user))
+		h = h + fmt.Sprintf("%s [%s]: %d failures, %d lockouts%s\n", v.Key, v.LastFail.Format(time.RFC3339), v.Count, v.Lockouts, lock)
+	}
+	c.String(200, h)
+}
+
+// curl -X POST -H "SharedKey: secret2" http://localhost:8001/unlock/user:user1
+func unlockStatus(c *gin.Context) {
+	c.Header("Content-Type", "text/plain")
+	key := lockoutKey(c.Param("key"))
+	if failures.Unlock(key) {
+		reqLog(c).Info(c.ClientIP(), " - Admin ", c.GetString("admin"), ": unlock ", key)
+		audit(c, AuditEvent{Event: AuditAdminUnlock, Reason: key})
+		c.String(200, fmt.Sprintf("%s unlocked\n", key))
 	} else {
-		c.String(404, "access forbiden")
+		c.String(200, fmt.Sprintf("no failure for %s\n", key))
 	}
 }
 
 func setAdmApi(r *gin.Engine) {
-	r.GET("/status", readStatus)
-	r.POST("/del/:login", delStatus)
-
+	config := currentConfig()
+	limit := rateLimit(config.RateAdmin, config.RateTrusted)
+	setAdmJSONApi(r.Group("/api", limit))
+	setAdmConsole(r.Group("/admin", limit))
+
+	a := r.Group("/", limit)
+	setMetricsApi(a)
+	a.GET("/status", adminAuth(ScopeStatusRead), readStatus)
+	a.POST("/del/:login", adminAuth(ScopeSessionsDelete), delStatus)
+	a.GET("/lockout", adminAuth(ScopeStatusRead), readLockout)
+	a.POST("/unlock/:key", adminAuth(ScopeSessionsDelete), unlockStatus)
+	a.POST("/reload", adminAuth(ScopeConfigReload), reloadLock(), reloadStatus)
+	a.POST("/keys/rotate", adminAuth(ScopeConfigReload), reloadLock(), rotateKeys)
 }
 
 func parseService(service string) (string, url.URL, url.Values) {
@@ -386,26 +536,31 @@ func getLocalURL(c *gin.Context) string {
 
 func login(c *gin.Context) {
 	service := c.Query("service")
-	log.Debug(c.ClientIP(), " - GET /login")
+	reqLog(c).Debug(c.ClientIP(), " - GET /login")
 	tgc := GetTGC(c)
 	if tgc != nil {
-		log.Info(c.ClientIP(), " - TGC for: ", tgc.User)
+		reqLog(c).Info(c.ClientIP(), " - TGC for: ", tgc.User)
 		localservice := getLocalURL(c) + "/login"
 		serv, l, q := parseService(service)
-		st := NewTicket("ST", serv, tgc.User, false)
+		ctx, span := startSpan(c, "ticket.issue", attribute.String("cas.service", serv))
+		st := addTicket(ctx, Ticket{Class: "ST", Service: serv, User: tgc.User, LongTerm: tgc.LongTerm, Parent: tgc.Value})
 		if serv != "" && serv != localservice {
-			log.Debug("new service: ", serv)
+			reqLog(c).Debug("new service: ", serv)
+			recordService(ctx, tgc, serv)
+			span.End()
+			audit(c, AuditEvent{Event: AuditTicketIssued, User: tgc.User, Service: serv, Ticket: ticketID(st.Value), Session: ticketID(tgc.Value)})
 			q.Set("ticket", st.Value)
 			l.RawQuery = q.Encode()
-			log.Debug("Redirect to Service: " + l.String())
+			reqLog(c).Debug("Redirect to Service: " + l.String())
 			c.Redirect(302, l.String())
 			return
 		}
+		span.End()
 		//service = localservice + "?ticket=" + st.Value
 		//fmt.Println("new service 2: ", service)
 	}
 
-	log.Debug("no TGC")
+	reqLog(c).Debug("no TGC")
 	lt := NewTicket("LT", "", "", false)
 	c.HTML(http.StatusOK, "login.tmpl", gin.H{
 		"title": "CAS Login",
@@ -413,8 +568,8 @@ func login(c *gin.Context) {
 	})
 }
 
-func testValidateUser(username, password string) bool {
-	log.Debug(fmt.Sprintf("Validate test User <%s> <%s>", username, password))
+func testValidateUser(l *logrus.Entry, username, password string) bool {
+	l.Debug(fmt.Sprintf("Validate test User <%s> <%s>", username, password))
 	if username == "" {
 		return false
 	}
@@ -425,91 +580,104 @@ func testValidateUser(username, password string) bool {
 }
 
 func loginPost(c *gin.Context) {
-	log.Debug(c.ClientIP(), " - POST /login")
+	reqLog(c).Debug(c.ClientIP(), " - POST /login")
+	config := currentConfig()
 	session := sessions.Default(c)
 	var s Status
 	t := session.Get("status")
 	if t != nil {
 		s = StrToStatus(t.(string))
 	}
-	//fmt.Printf("=> count %+v\n", s.Count)
-	s = userFailLimiter(s, 30)
 
 	service := c.Query("service")
 	username := c.PostForm("username")
 	password := c.PostForm("password")
+	rememberMe := c.PostForm("rememberMe") == "true"
 
 	var IsGoodChar = regexp.MustCompile(`^[a-zA-Z0-9\.\@]+$`).MatchString
 	if IsGoodChar(username) == false {
-		log.Error("Bad Char in username")
+		reqLog(c).Error("Bad Char in username")
 		username = ""
 	}
 	if len(username) > 64 {
-		log.Error("username too long")
+		reqLog(c).Error("username too long")
 		username = ""
 	}
 	if len(password) > 256 {
-		log.Error("password too long")
+		reqLog(c).Error("password too long")
 		password = ""
 	}
 
 	//lt := c.PostForm("lt") // TODO validate lt
+	// failures name the service like login_success, without its query
+	failedService, _, _ := parseService(service)
 
 	switch {
-	case s.Lock == true:
-		session.Set("status", s.ToJSONStr())
-		session.Save()
-		c.Header("Content-Type", "text/html")
-		c.String(200, "<html>Too many errors, come back later</html>")
-		log.Debug(c.ClientIP(), " - Lock Status")
+	case lockedOut(username, c.ClientIP()) > 0:
+		errorPage(c, "Too many errors, come back later")
+		reqLog(c).Debug(c.ClientIP(), " - Lock Status")
+		metricLogins.WithLabelValues(config.Backend, "locked").Inc()
+		audit(c, AuditEvent{Event: AuditLoginFailure, User: username, Service: failedService, Backend: config.Backend, Reason: "locked"})
 	case username != "" && password != "":
 		valid := false
-		if *backend == "test" {
-			valid = testValidateUser(username, password)
+		start := time.Now()
+		_, span := startSpan(c, "backend."+config.Backend, attribute.String("enduser.id", username))
+		if config.Backend == "test" {
+			valid = testValidateUser(reqLog(c), username, password)
 		}
-		if *backend == "ldap" {
-			valid = ldapValidateUser(username, password, config)
+		if config.Backend == "ldap" {
+			valid = ldapValidateUser(reqLog(c), username, password, *config)
 		}
+		span.SetAttributes(attribute.Bool("cas.auth.valid", valid))
+		span.End()
+		metricBackendLatency.WithLabelValues(config.Backend).Observe(time.Since(start).Seconds())
 		if valid == true {
+			metricLogins.WithLabelValues(config.Backend, "success").Inc()
+			authSucceeded(username)
 			s.User = username
-			s.Count = 0
 			s.Confirm = false
 			session.Set("status", s.ToJSONStr())
 			session.Save()
 
 			serv, l, q := parseService(service)
-			log.Info(c.ClientIP(), " - AUTHENTICATION [username:", username, "] [service:", serv, "]")
-			st := NewTicket("ST", serv, username, true)
-			NewTGC(c, st)
+			reqLog(c).Info(c.ClientIP(), " - AUTHENTICATION [username:", username, "] [service:", serv, "]")
+			tgt := NewTGC(c, username, serv, rememberMe)
+			ctx, span := startSpan(c, "ticket.issue", attribute.String("cas.service", serv))
+			st := addTicket(ctx, Ticket{Class: "ST", Service: serv, User: username, Renew: true, LongTerm: rememberMe, Parent: tgt.Value})
+			span.End()
+			audit(c, AuditEvent{Event: AuditLoginSuccess, User: username, Service: serv, Backend: config.Backend, Session: ticketID(tgt.Value)})
+			if serv != "" {
+				audit(c, AuditEvent{Event: AuditTicketIssued, User: username, Service: serv, Ticket: ticketID(st.Value), Session: ticketID(tgt.Value)})
+			}
 			if service != "" {
 				q.Set("ticket", st.Value)
 				l.RawQuery = q.Encode()
-				log.Debug("Post Redirect to Service: " + l.String())
+				reqLog(c).Debug("Post Redirect to Service: " + l.String())
 				c.Redirect(302, l.String())
 			} else {
-				log.Info(c.ClientIP(), " - auth without service")
+				reqLog(c).Info(c.ClientIP(), " - auth without service")
 				c.Redirect(303, getLocalURL(c)+"/login")
 			}
 		} else {
-			log.Info(c.ClientIP(), " - AUTHENTICATION failed for ", username)
-			session.Set("status", s.ToJSONStr())
-			session.Save()
-			c.Header("Content-Type", "text/html")
-			c.String(200, "<html>bad user or pass</html>")
+			reqLog(c).Info(c.ClientIP(), " - AUTHENTICATION failed for ", username)
+			metricLogins.WithLabelValues(config.Backend, "failure").Inc()
+			audit(c, AuditEvent{Event: AuditLoginFailure, User: username, Service: failedService, Backend: config.Backend, Reason: "bad credentials"})
+			authFailed(c, username)
+			errorPage(c, "bad user or pass")
 		}
 	default:
-		log.Error(c.ClientIP(), " - Bad Post params")
-		c.Header("Content-Type", "text/html")
-		c.String(200, "<html>Error</html>")
+		reqLog(c).Error(c.ClientIP(), " - Bad Post params")
+		errorPage(c, "Error")
 		//c.Redirect(303, getLocalURL(c) + "/login" )
 	}
 }
 
 func logout(c *gin.Context) {
-	log.Debug("Logout")
+	reqLog(c).Debug("Logout")
 	tgc := GetTGC(c)
 	if tgc != nil {
-		log.Info(c.ClientIP(), " - Logout: DeleteTGC for ", tgc.User)
+		reqLog(c).Info(c.ClientIP(), " - Logout: DeleteTGC for ", tgc.User)
+		audit(c, AuditEvent{Event: AuditLogout, User: tgc.User, Session: ticketID(tgc.Value)})
 		DeleteTGC(c)
 		c.Writer.Write([]byte("User has been logged out"))
 	} else {
@@ -517,32 +685,110 @@ func logout(c *gin.Context) {
 	}
 }
 
+// ValidationError : CAS validation failure code and message
+type ValidationError struct {
+	Code    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// validateTicket : check and consume a ticket in one registry operation, so
+// concurrent validations of the same ticket can't both succeed.
+// Only tickets of one of classes are accepted, a refused ST or PT is removed
+// so it can't be tried again against another service.
+func validateTicket(ctx context.Context, ticket string, serv string, classes ...string) (v *Ticket, verr *ValidationError) {
+	defer func() {
+		if verr != nil {
+			metricValidationFailures.WithLabelValues(verr.Code).Inc()
+		} else {
+			metricTicketsValidated.WithLabelValues(v.Class).Inc()
+		}
+	}()
+	if ticket == "" {
+		return nil, &ValidationError{"INVALID_TICKET", "Empty Ticket"}
+	}
+	check := func(t *Ticket) error {
+		if contains(classes, t.Class) == false {
+			return &ValidationError{"INVALID_TICKET_SPEC", "Ticket class " + t.Class + " can't be validated here"}
+		}
+		if ticketPolicy(*t).IsExpired(*t, time.Now()) {
+			return &ValidationError{"INVALID_TICKET", "Ticket expired"}
+		}
+		if t.Service != serv {
+			return &ValidationError{"INVALID_SERVICE", "Ticket was used for another service than it was generated for"}
+		}
+		return nil
+	}
+	var t *Ticket
+	err := traceRegistry(ctx, "consume", func() (err error) {
+		t, err = registry.Consume(ticket, check)
+		return err
+	})
+	if err != nil {
+		if verr, ok := err.(*ValidationError); ok {
+			return t, verr
+		}
+		if err != ErrTicketNotFound {
+			log.Error(err)
+		}
+		return nil, &ValidationError{"INVALID_TICKET", "Ticket not recognized"}
+	}
+	return t, nil
+}
+
+// auditValidation : audit a ticket validation and its result
+func auditValidation(c *gin.Context, ticket string, serv string, t *Ticket, err *ValidationError) {
+	e := AuditEvent{Event: AuditValidated, Service: serv, Ticket: ticketID(ticket)}
+	if t != nil {
+		e.User = t.User
+		e.Session = ticketID(t.Parent)
+	}
+	if err != nil {
+		e.Event = AuditInvalid
+		e.Reason = err.Code
+	}
+	audit(c, e)
+}
+
 func serviceValidate(c *gin.Context) {
 	service := c.Query("service")
 	ticket := c.Query("ticket")
 	serv, _, _ := parseService(service)
 
-	log.Debug(fmt.Sprintf("CASv2: serviceValidate <%s> <%s>", service, ticket))
-	if ticket == "" {
-		log.Debug("INVALID_TICKET, empty ticket")
-		c.Writer.Write(NewCASFailureResponse("INVALID_TICKET", "Empty Ticket"))
-	} else {
-		t := GetTicket(ticket)
-		if t == nil {
-			log.Debug("INVALID_TICKET, Ticket not recognized")
-			c.Writer.Write(NewCASFailureResponse("INVALID_TICKET", "Ticket not recognized"))
-		} else {
-			if t.Service != serv {
-				log.Debug("INVALID_SERVICE")
-				c.Writer.Write(NewCASFailureResponse("INVALID_SERVICE", "Ticket was used for another service than it was generated for"))
-			} else {
-				DeleteTicket(ticket)
-				//fmt.Printf("=> User <%s>\n", t.User)
-				log.Info(c.ClientIP(), " - ServiceValidate_CASv2 [username:", t.User, "] [service:", serv, "]")
-				c.Writer.Write(NewCASSuccessResponse(t.User))
-			}
-		}
+	reqLog(c).Debug(fmt.Sprintf("CASv2: serviceValidate <%s> <%s>", service, ticket))
+	// proxy tickets are refused by serviceValidate
+	t, err := traceValidateTicket(c, ticket, serv, "ST")
+	auditValidation(c, ticket, serv, t, err)
+	if err != nil {
+		reqLog(c).Debug(err.Code, ", ", err.Message)
+		c.Writer.Write(NewCASFailureResponse(err.Code, err.Message))
+		return
 	}
+	reqLog(c).Info(c.ClientIP(), " - ServiceValidate_CASv2 [username:", t.User, "] [service:", serv, "]")
+	c.Writer.Write(NewCASSuccessResponse(t.User, nil))
+}
+
+func serviceValidateV3(c *gin.Context) {
+	service := c.Query("service")
+	ticket := c.Query("ticket")
+	serv, _, _ := parseService(service)
+
+	reqLog(c).Debug(fmt.Sprintf("CASv3: serviceValidate <%s> <%s>", service, ticket))
+	t, err := traceValidateTicket(c, ticket, serv, "ST")
+	auditValidation(c, ticket, serv, t, err)
+	if err != nil {
+		reqLog(c).Debug(err.Code, ", ", err.Message)
+		c.Writer.Write(NewCASFailureResponse(err.Code, err.Message))
+		return
+	}
+	reqLog(c).Info(c.ClientIP(), " - ServiceValidate_CASv3 [username:", t.User, "] [service:", serv, "]")
+	c.Writer.Write(NewCASSuccessResponse(t.User, &CASAttributes{
+		IsFromNewLogin:                         t.Renew,
+		LongTermAuthenticationRequestTokenUsed: t.LongTerm,
+	}))
 }
 
 func validate(c *gin.Context) {
@@ -550,22 +796,14 @@ func validate(c *gin.Context) {
 	ticket := c.Query("ticket")
 	serv, _, _ := parseService(service)
 
-	log.Debug(fmt.Sprintf("CASv1: validate <%s> <%s>\n", service, ticket))
-	if ticket == "" {
+	reqLog(c).Debug(fmt.Sprintf("CASv1: validate <%s> <%s>\n", service, ticket))
+	t, err := traceValidateTicket(c, ticket, serv, "ST")
+	auditValidation(c, ticket, serv, t, err)
+	if err != nil {
+		reqLog(c).Debug(err.Code, ", ", err.Message)
 		c.Writer.Write([]byte("no\n"))
-	} else {
-		t := GetTicket(ticket)
-		if t == nil {
-			c.Writer.Write([]byte("no\n"))
-		} else {
-			if t.Service != serv {
-				c.Writer.Write([]byte("no\n"))
-			} else {
-				DeleteTicket(ticket)
-				//fmt.Printf("=> User <%s>\n", t.User)
-				log.Info(c.ClientIP(), " - ServiceValidate_CASv1 [username:", t.User, "] [service:", serv, "]")
-				c.Writer.Write([]byte("yes\n" + t.User + "\n"))
-			}
-		}
+		return
 	}
+	reqLog(c).Info(c.ClientIP(), " - ServiceValidate_CASv1 [username:", t.User, "] [service:", serv, "]")
+	c.Writer.Write([]byte("yes\n" + t.User + "\n"))
 }
@@ -1,17 +1,59 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/securecookie"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
 var srv *httptest.Server
 
+// withConfig : server of the running config changed by edit, the config is
+// restored when the test ends
+func withConfig(t *testing.T, edit func(c *Config)) *gin.Engine {
+	saved := *currentConfig()
+	t.Cleanup(func() { setConfig(saved) })
+	c := saved
+	if edit != nil {
+		edit(&c)
+	}
+	setConfig(c)
+	return setupServer()
+}
+
+// request : response of r to method on path, with the SharedKey header when
+// key is set
+func request(r http.Handler, method string, path string, key string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, nil)
+	if key != "" {
+		req.Header.Set("SharedKey", key)
+	}
+	r.ServeHTTP(w, req)
+	return w
+}
+
 func TestMain(t *testing.T) {
 	// The setupServer method is injected into a test server
 	authSrv := httptest.NewServer(setupServer())
@@ -124,3 +166,522 @@ func TestMain(t *testing.T) {
 	    t.Fatalf("Expected \"application/json; charset=utf-8\", got %s", val[0])
 	}*/
 }
+
+func TestConcurrentServiceValidate(t *testing.T) {
+	r := gin.New()
+	r.GET("/serviceValidate", serviceValidate)
+	service := "http://service.example.org/"
+	st := NewTicket("ST", service, "user1", false)
+
+	var wg sync.WaitGroup
+	var won int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/serviceValidate?service="+url.QueryEscape(service)+"&ticket="+st.Value, nil)
+			r.ServeHTTP(w, req)
+			if strings.Contains(w.Body.String(), "cas:authenticationSuccess") {
+				atomic.AddInt32(&won, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), won, "only one validator wins")
+}
+
+func TestValidateTicketSpec(t *testing.T) {
+	service := "http://service.example.org/"
+
+	tgt := NewTicket("TGT", service, "user1", false)
+	_, err := validateTicket(context.Background(), tgt.Value, service, "ST")
+	assert.Equal(t, "INVALID_TICKET_SPEC", err.Code, "TGT refused")
+	assert.NotNil(t, GetTicket(tgt.Value), "refused TGT is kept")
+
+	lt := NewTicket("LT", service, "", false)
+	_, err = validateTicket(context.Background(), lt.Value, service, "ST")
+	assert.Equal(t, "INVALID_TICKET_SPEC", err.Code, "LT refused")
+
+	st := NewTicket("ST", service, "user1", false)
+	_, err = validateTicket(context.Background(), st.Value, "http://other.example.org/", "ST")
+	assert.Equal(t, "INVALID_SERVICE", err.Code, "bad service")
+	_, err = validateTicket(context.Background(), st.Value, service, "ST")
+	assert.Equal(t, "INVALID_TICKET", err.Code, "ST invalidated by a failed validation")
+
+	pt := NewTicket("PT", service, "user1", false)
+	_, err = validateTicket(context.Background(), pt.Value, service, "ST")
+	assert.Equal(t, "INVALID_TICKET_SPEC", err.Code, "PT refused")
+	assert.Nil(t, GetTicket(pt.Value), "refused PT is removed")
+
+	old := Ticket{Class: "ST", Value: "ST-old", User: "user1", Service: service,
+		CreatedAt: time.Now().Add(-ticketPolicy(Ticket{Class: "ST"}).TimeToLive - time.Second)}
+	registry.Add(old)
+	_, err = validateTicket(context.Background(), old.Value, service, "ST")
+	assert.Equal(t, "INVALID_TICKET", err.Code, "expired ST")
+
+	st = NewTicket("ST", service, "user1", false)
+	v, err := validateTicket(context.Background(), st.Value, service, "ST")
+	assert.Nil(t, err, "valid ST")
+	assert.Equal(t, "user1", v.User, "ST user")
+}
+
+func TestRememberMe(t *testing.T) {
+	authSrv := httptest.NewServer(setupServer())
+	defer authSrv.Close()
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	service := "http://service.example.org/"
+
+	formData := url.Values{}
+	formData.Set("username", "user")
+	formData.Set("password", "user")
+	formData.Set("rememberMe", "true")
+	resp, err := client.PostForm(fmt.Sprintf("%s/login?service=%s", authSrv.URL, url.QueryEscape(service)), formData)
+	assert.Nil(t, err, "login")
+	assert.Equal(t, 302, resp.StatusCode, "redirect to service")
+
+	var tgc *http.Cookie
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == cookieName {
+			tgc = cookie
+		}
+	}
+	assert.NotNil(t, tgc, "TGC cookie")
+	assert.True(t, tgc.MaxAge > 0, "persistent TGC cookie")
+
+	l, _ := url.Parse(resp.Header.Get("Location"))
+	ticket := l.Query().Get("ticket")
+	respV, err := client.Get(fmt.Sprintf("%s/p3/serviceValidate?service=%s&ticket=%s", authSrv.URL, url.QueryEscape(service), ticket))
+	assert.Nil(t, err, "validate")
+	body, _ := ioutil.ReadAll(respV.Body)
+	assert.Contains(t, string(body), "<cas:longTermAuthenticationRequestTokenUsed>true</cas:longTermAuthenticationRequestTokenUsed>", "long term authentication")
+
+	// logout removes the persistent cookie: same path, max age < 0
+	req, _ := http.NewRequest("GET", authSrv.URL+"/logout", nil)
+	req.AddCookie(tgc)
+	resp, err = client.Do(req)
+	assert.Nil(t, err, "logout")
+	var deleted *http.Cookie
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == cookieName {
+			deleted = cookie
+		}
+	}
+	assert.NotNil(t, deleted, "TGC cookie deleted")
+	assert.Equal(t, tgc.Path, deleted.Path, "same cookie path")
+	assert.True(t, deleted.MaxAge < 0, "cookie expired")
+}
+
+func TestAdminAuth(t *testing.T) {
+	r := withConfig(t, func(c *Config) {
+		c.AdmStatusRead = []string{"secret1"}
+		c.AdmStatusDel = nil
+		c.AdminKeys = []AdminKey{{Name: "ops", Hash: hashAdminKey("secret2"), Scopes: []string{ScopeSessionsDelete}}}
+	})
+	do := func(method string, path string, key string) int {
+		return request(r, method, path, key).Code
+	}
+
+	assert.Equal(t, 401, do("GET", "/status", ""), "missing key")
+	assert.Equal(t, 401, do("GET", "/status", "bad"), "unknown key")
+	assert.Equal(t, 200, do("GET", "/status", "secret1"), "read key")
+	assert.Equal(t, 403, do("POST", "/del/user1", "secret1"), "read key can't delete")
+	assert.Equal(t, 200, do("POST", "/del/user1", "secret2"), "delete key")
+	assert.Equal(t, 403, do("GET", "/status", "secret2"), "delete only key can't read")
+
+	// legacy keys are not written in the spare capacity of AdminKeys
+	keys := make([]AdminKey, 1, 4)
+	keys[0] = AdminKey{Name: "ops"}
+	assert.Equal(t, 2, len(adminKeys(Config{AdminKeys: keys, AdmStatusRead: []string{"secret1"}})), "legacy key added")
+	assert.Equal(t, AdminKey{}, keys[:2][1], "config keys untouched")
+}
+
+func TestRandString(t *testing.T) {
+	s := RandString(32)
+	assert.Regexp(t, `^[a-zA-Z]{32}$`, s, "32 letters")
+	assert.NotEqual(t, s, RandString(32), "random")
+}
+
+func TestRecordService(t *testing.T) {
+	tgt := NewTicket("TGT", "", "user1", false)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// each login works on its own copy of the TGT
+			recordService(context.Background(), GetTicket(tgt.Value), fmt.Sprintf("http://app%d.example.org/", i))
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 10, len(GetTicket(tgt.Value).Services), "no service lost")
+
+	DeleteTicket(tgt.Value)
+	recordService(context.Background(), tgt, "http://other.example.org/")
+	assert.Nil(t, GetTicket(tgt.Value), "removed TGT not written back")
+}
+
+func TestAdminJSONApi(t *testing.T) {
+	r := withConfig(t, func(c *Config) { c.AdmStatusDel = []string{"secret2"} })
+	do := func(method string, path string) (int, map[string]interface{}) {
+		w := request(r, method, path, "secret2")
+		var m map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &m)
+		return w.Code, m
+	}
+
+	service := "http://app.example.org/"
+	tgt := addTicket(context.Background(), Ticket{Class: "TGT", User: "jsonuser", Services: []string{service}})
+	addTicket(context.Background(), Ticket{Class: "ST", User: "jsonuser", Service: service, Parent: tgt.Value})
+	addTicket(context.Background(), Ticket{Class: "TGT", User: "jsonuser"})
+
+	code, m := do("GET", "/api/tickets?user=jsonuser&class=TGT&limit=1")
+	assert.Equal(t, 200, code, "list tickets")
+	assert.Equal(t, float64(2), m["total"], "filter by user and class")
+	assert.Equal(t, 1, len(m["tickets"].([]interface{})), "paginated")
+
+	code, m = do("GET", "/api/sessions/"+ticketID(tgt.Value))
+	assert.Equal(t, 200, code, "get session")
+	assert.Equal(t, []interface{}{service}, m["services"], "session services")
+	assert.Equal(t, 1, len(m["tickets"].([]interface{})), "session tickets")
+
+	code, m = do("DELETE", "/api/sessions?service="+url.QueryEscape(service))
+	assert.Equal(t, 200, code, "bulk delete by service")
+	assert.Equal(t, float64(2), m["deleted"], "bulk delete by service")
+	code, _ = do("GET", "/api/sessions/"+ticketID(tgt.Value))
+	assert.Equal(t, 404, code, "session deleted")
+
+	code, m = do("DELETE", "/api/sessions?user=jsonuser")
+	assert.Equal(t, 200, code, "bulk delete by user")
+	assert.Equal(t, float64(1), m["deleted"], "bulk delete by user")
+}
+
+func TestAdminConsole(t *testing.T) {
+	authSrv := httptest.NewServer(withConfig(t, func(c *Config) { c.AdmStatusDel = []string{"secret2"} }))
+	defer authSrv.Close()
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	addTicket(context.Background(), Ticket{Class: "TGT", User: "consoleuser"})
+
+	req, _ := http.NewRequest("GET", authSrv.URL+"/admin", nil)
+	resp, _ := client.Do(req)
+	assert.Equal(t, 401, resp.StatusCode, "basic auth required")
+
+	req.SetBasicAuth("admin", "secret2")
+	resp, _ = client.Do(req)
+	assert.Equal(t, 200, resp.StatusCode, "console")
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Contains(t, string(body), "consoleuser", "active session")
+	token := regexp.MustCompile(`name="token" value="([a-zA-Z0-9]+)"`).FindStringSubmatch(string(body))[1]
+
+	post := func(form url.Values) int {
+		req, _ := http.NewRequest("POST", authSrv.URL+"/admin/kill", strings.NewReader(form.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("admin", "secret2")
+		resp, _ := client.Do(req)
+		return resp.StatusCode
+	}
+	assert.Equal(t, 403, post(url.Values{"user": {"consoleuser"}}), "form token required")
+	assert.Equal(t, 303, post(url.Values{"user": {"consoleuser"}, "token": {token}}), "kill user sessions")
+	assert.Equal(t, 0, len(registry.ListByUser("consoleuser")), "sessions killed")
+}
+
+func TestMetrics(t *testing.T) {
+	r := withConfig(t, func(c *Config) { c.AdmStatusRead = []string{"secret1"} })
+
+	service := "http://metrics.example.org/"
+	st := NewTicket("ST", service, "user1", false)
+	validateTicket(context.Background(), st.Value, service, "ST")
+	validateTicket(context.Background(), st.Value, service, "ST")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	req.SetBasicAuth("prometheus", "secret1")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code, "metrics")
+	body := w.Body.String()
+	assert.Contains(t, body, `cas_tickets_issued_total{class="ST"}`, "issued tickets")
+	assert.Contains(t, body, `cas_tickets_validated_total{class="ST"}`, "validated tickets")
+	assert.Contains(t, body, `cas_validation_failures_total{code="INVALID_TICKET"}`, "validation failures")
+	assert.Contains(t, body, `cas_tickets_live{class="TGT"}`, "live tickets")
+}
+
+func TestHealth(t *testing.T) {
+	r := withConfig(t, nil)
+	get := func(path string) (int, string) {
+		w := request(r, "GET", path, "")
+		return w.Code, w.Body.String()
+	}
+
+	code, _ := get("/health")
+	assert.Equal(t, 200, code, "process up")
+	code, body := get("/ready")
+	assert.Equal(t, 200, code, "test backend and memory registry ready")
+	assert.Contains(t, body, `"registry":{"status":"ok"}`, "registry status")
+
+	// no ldap server listening
+	r = withConfig(t, func(c *Config) {
+		c.Backend = "ldap"
+		c.LdapServer = "127.0.0.1"
+	})
+	code, body = get("/ready")
+	assert.Equal(t, 503, code, "ldap down")
+	assert.Contains(t, body, `"backend:ldap":{"status":"fail"}`, "backend status without error details")
+	checked := backendStatus.at
+	code, _ = get("/ready")
+	assert.Equal(t, 503, code, "ldap still down")
+	assert.Equal(t, checked, backendStatus.at, "backend check reused")
+}
+
+func TestAudit(t *testing.T) {
+	var buf bytes.Buffer
+	auditOut = &buf
+	defer func() { auditOut = ioutil.Discard }()
+	r := setupServer()
+	service := "http://audit.example.org/"
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/login?service="+url.QueryEscape(service+"?lang=fr"), strings.NewReader("username=audit&password=bad"))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	r.ServeHTTP(w, req)
+
+	st := NewTicket("ST", service, "audit", false)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/serviceValidate?service="+url.QueryEscape(service)+"&ticket="+st.Value, nil)
+	req.Header.Set("User-Agent", "audit-test")
+	r.ServeHTTP(w, req)
+
+	// an expired TGT presented by its cookie
+	expired := Ticket{Class: "TGT", Value: "TGT-expired", User: "audit",
+		CreatedAt: time.Now().Add(-ticketPolicy(Ticket{Class: "TGT"}).TimeToLive - time.Second)}
+	registry.Add(expired)
+	cookie, _ := securecookie.EncodeMulti(cookieName, expired.Value, codecs()...)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/login", nil)
+	req.AddCookie(&http.Cookie{Name: cookieName, Value: cookie})
+	r.ServeHTTP(w, req)
+
+	var events []AuditEvent
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e AuditEvent
+		assert.Nil(t, json.Unmarshal([]byte(line), &e), "JSON line")
+		events = append(events, e)
+	}
+	assert.Equal(t, 3, len(events), "three events")
+	assert.Equal(t, AuditLoginFailure, events[0].Event, "login failure")
+	assert.Equal(t, "bad credentials", events[0].Reason, "failure reason")
+	assert.Equal(t, service, events[0].Service, "service without query, like login_success")
+	assert.Equal(t, AuditValidated, events[1].Event, "ticket validated")
+	assert.Equal(t, ticketID(st.Value), events[1].Ticket, "ticket id hash")
+	assert.Equal(t, "audit-test", events[1].UserAgent, "user agent")
+	assert.Equal(t, AuditSessionExpired, events[2].Event, "expired session")
+	assert.Equal(t, ticketID(expired.Value), events[2].Session, "expired session id")
+	assert.NotContains(t, buf.String(), st.Value, "no raw ticket in audit log")
+}
+
+func TestWebhooks(t *testing.T) {
+	received := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	var calls int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// first delivery fails, retried
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(500)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- b
+	}))
+	defer hook.Close()
+
+	w := NewWebhooks(Config{WebhookURLs: []string{hook.URL}, WebhookSecret: "s", WebhookRetries: 2})
+	w.backoff = 10 * time.Millisecond
+	w.Start()
+	defer w.Stop()
+
+	w.Send(AuditEvent{Event: AuditTicketIssued, User: "user1"})
+	w.Send(AuditEvent{Event: AuditLogout, User: "user1"})
+
+	select {
+	case r := <-received:
+		b := <-bodies
+		var e AuditEvent
+		json.Unmarshal(b, &e)
+		assert.Equal(t, AuditLogout, e.Event, "only configured events are sent")
+		ts := r.Header.Get("X-CAS-Timestamp")
+		assert.NotEqual(t, "", ts, "timestamp header")
+		assert.Equal(t, w.Sign(ts, b), r.Header.Get("X-CAS-Signature"), "signed timestamp and body")
+		assert.NotEqual(t, w.Sign("0", b), r.Header.Get("X-CAS-Signature"), "timestamp is signed")
+		assert.Equal(t, int32(2), atomic.LoadInt32(&calls), "retried")
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not received")
+	}
+
+	// a full queue drops events instead of blocking
+	full := NewWebhooks(Config{WebhookURLs: []string{hook.URL}, WebhookQueueSize: 1})
+	full.Send(AuditEvent{Event: AuditLogout})
+	full.Send(AuditEvent{Event: AuditLogout})
+	assert.Equal(t, 1, len(full.targets[0].queue), "bounded queue")
+
+	// a slow receiver doesn't delay the others
+	release := make(chan bool)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast := make(chan bool, 1)
+	quick := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fast <- true
+	}))
+	defer quick.Close()
+	both := NewWebhooks(Config{WebhookURLs: []string{slow.URL, quick.URL}})
+	both.Start()
+	defer both.Stop()
+	both.Send(AuditEvent{Event: AuditLogout})
+	select {
+	case <-fast:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook delayed by a slow receiver")
+	}
+}
+
+func TestTracing(t *testing.T) {
+	confTracing(Config{})
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	defer otel.SetTracerProvider(oteltrace.NewNoopTracerProvider())
+	r := setupServer()
+	service := "http://trace.example.org/"
+
+	st := NewTicket("ST", service, "trace", false)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/serviceValidate?service="+url.QueryEscape(service)+"&ticket="+st.Value, nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.ServeHTTP(w, req)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range sr.Ended() {
+		spans[s.Name()] = s
+	}
+	server, ok := spans["GET /serviceValidate"]
+	assert.True(t, ok, "server span")
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.SpanContext().TraceID().String(), "incoming trace continued")
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String(), "remote parent")
+	validate, ok := spans["ticket.validate"]
+	assert.True(t, ok, "validation span")
+	assert.Equal(t, server.SpanContext().SpanID(), validate.Parent().SpanID(), "child of the server span")
+	consume, ok := spans["registry.consume"]
+	assert.True(t, ok, "registry span")
+	assert.Equal(t, validate.SpanContext().SpanID(), consume.Parent().SpanID(), "child of the validation span")
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/login", strings.NewReader("username=trace&password=trace"))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	r.ServeHTTP(w, req)
+	names := []string{}
+	for _, s := range sr.Ended() {
+		names = append(names, s.Name())
+	}
+	assert.Contains(t, names, "backend.test", "backend span")
+	assert.Contains(t, names, "ticket.issue", "ticket span")
+
+	// SSO: a ST issued from the TGT of the cookie
+	var tgc *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == cookieName {
+			tgc = cookie
+		}
+	}
+	sr2 := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr2)))
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/login?service="+url.QueryEscape(service), nil)
+	req.AddCookie(tgc)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 302, w.Code, "SSO redirect")
+	spans = map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range sr2.Ended() {
+		spans[s.Name()] = s
+	}
+	issue, ok := spans["ticket.issue"]
+	assert.True(t, ok, "SSO ticket span")
+	add, ok := spans["registry.add"]
+	assert.True(t, ok, "registry add span")
+	assert.Equal(t, issue.SpanContext().SpanID(), add.Parent().SpanID(), "ST stored in the ticket span")
+	_, ok = spans["registry.update"]
+	assert.True(t, ok, "TGT update span")
+}
+
+func TestJSONLogs(t *testing.T) {
+	confLog("", "json", "", true)
+	defer confLog("", "", "", true)
+	var access, app bytes.Buffer
+	accessLog.SetOutput(&access)
+	log.SetOutput(&app)
+	r := setupServer()
+	service := "http://logs.example.org/"
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/login?service="+url.QueryEscape(service), strings.NewReader("username=logs&password=logs"))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	r.ServeHTTP(w, req)
+
+	var line map[string]interface{}
+	assert.Nil(t, json.Unmarshal(access.Bytes(), &line), "access log is JSON")
+	assert.Equal(t, "POST", line["method"], "method")
+	assert.Equal(t, "/login", line["path"], "path")
+	assert.Equal(t, float64(302), line["status"], "status")
+	assert.Equal(t, "logs", line["user"], "user")
+	assert.Equal(t, service, line["service"], "service")
+	assert.Contains(t, line, "latency_ms", "latency")
+	assert.Contains(t, line, "client_ip", "client ip")
+
+	found := false
+	for _, l := range strings.Split(strings.TrimSpace(app.String()), "\n") {
+		var e map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(l), &e), "app log is JSON")
+		if strings.Contains(e["msg"].(string), "AUTHENTICATION") {
+			found = true
+			assert.Equal(t, "/login", e["path"], "request fields")
+		}
+	}
+	assert.True(t, found, "authentication logged")
+}
+
+func TestRequestID(t *testing.T) {
+	var buf, app bytes.Buffer
+	auditOut = &buf
+	defer func() { auditOut = ioutil.Discard }()
+	log.SetOutput(&app)
+	defer log.SetOutput(os.Stderr)
+	r := setupServer()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/login", strings.NewReader("username=reqid&password=bad"))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Request-ID", "support-42")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, "support-42", w.Header().Get("X-Request-ID"), "request id echoed")
+	assert.Contains(t, w.Body.String(), "support-42", "request id on the error page")
+	assert.Contains(t, buf.String(), `"requestId":"support-42"`, "request id in audit event")
+	assert.Contains(t, app.String(), "[request_id:support-42]", "request id in app log")
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/login", nil)
+	req.Header.Set("X-Request-ID", "bad id\n")
+	r.ServeHTTP(w, req)
+	id := w.Header().Get("X-Request-ID")
+	assert.NotEqual(t, "", id, "request id generated")
+	assert.NotEqual(t, "bad id\n", id, "invalid request id replaced")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+/* Prometheus metrics */
+
+var (
+	metricLogins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cas_logins_total",
+		Help: "Login attempts per backend and result.",
+	}, []string{"backend", "result"})
+	metricTicketsIssued = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cas_tickets_issued_total",
+		Help: "Tickets issued per class.",
+	}, []string{"class"})
+	metricTicketsValidated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cas_tickets_validated_total",
+		Help: "Tickets successfully validated per class.",
+	}, []string{"class"})
+	metricTicketsExpired = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cas_tickets_expired_total",
+		Help: "Tickets removed by the expiration sweep per class.",
+	}, []string{"class"})
+	metricValidationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cas_validation_failures_total",
+		Help: "Ticket validation failures per CAS error code.",
+	}, []string{"code"})
+	metricRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cas_ratelimit_rejections_total",
+		Help: "Requests rejected by the rate limiter per route.",
+	}, []string{"route"})
+	metricBackendLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cas_backend_duration_seconds",
+		Help:    "Authentication backend call latency.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"backend"})
+
+	metricLiveTickets = prometheus.NewDesc("cas_tickets_live",
+		"Tickets currently in the registry per class.", []string{"class"}, nil)
+)
+
+// liveTicketsCollector : count registry tickets on each scrape
+type liveTicketsCollector struct{}
+
+func (liveTicketsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- metricLiveTickets
+}
+
+func (liveTicketsCollector) Collect(ch chan<- prometheus.Metric) {
+	counts := map[string]int{"TGT": 0, "ST": 0, "LT": 0}
+	for _, t := range registry.List() {
+		counts[t.Class]++
+	}
+	for class, n := range counts {
+		ch <- prometheus.MustNewConstMetric(metricLiveTickets, prometheus.GaugeValue, float64(n), class)
+	}
+}
+
+func init() {
+	prometheus.MustRegister(
+		metricLogins,
+		metricTicketsIssued,
+		metricTicketsValidated,
+		metricTicketsExpired,
+		metricValidationFailures,
+		metricRateLimited,
+		metricBackendLatency,
+		liveTicketsCollector{},
+	)
+}
+
+// curl -u admin:secret1 http://localhost:8001/metrics
+func setMetricsApi(a *gin.RouterGroup) {
+	a.GET("/metrics", adminAuth(ScopeStatusRead), gin.WrapH(promhttp.Handler()))
+}
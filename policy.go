@@ -0,0 +1,76 @@
+package main
+
+import (
+	"time"
+)
+
+/* Expiration policies: ticket lifetime per class */
+
+// ExpirationPolicy : ticket lifetime rules, a zero value disables a rule
+type ExpirationPolicy struct {
+	TimeToLive  time.Duration // hard maximum since creation
+	IdleTimeout time.Duration // sliding maximum since last use
+	MaxUses     int           // number of validations
+}
+
+// ticketPolicy : policy applied to a ticket, read from config on each call
+func ticketPolicy(t Ticket) ExpirationPolicy {
+	config := currentConfig()
+	switch {
+	case t.Class == "TGT" && t.LongTerm:
+		return ExpirationPolicy{
+			TimeToLive:  time.Duration(config.RememberMeValidPeriod) * time.Hour,
+			IdleTimeout: time.Duration(config.RememberMeIdleTimeout) * time.Minute,
+		}
+	case t.Class == "TGT":
+		return ExpirationPolicy{
+			TimeToLive:  time.Duration(config.TGCvalidPeriod) * time.Hour,
+			IdleTimeout: time.Duration(config.TGCidleTimeout) * time.Minute,
+		}
+	case t.Class == "ST":
+		return ExpirationPolicy{
+			TimeToLive: time.Duration(config.STvalidPeriod) * time.Second,
+			MaxUses:    config.STmaxUses,
+		}
+	case t.Class == "PT":
+		return ExpirationPolicy{
+			TimeToLive: time.Duration(config.PTvalidPeriod) * time.Second,
+			MaxUses:    config.PTmaxUses,
+		}
+	}
+	return ExpirationPolicy{
+		TimeToLive: time.Duration(garbageCollectionPeriod) * time.Minute,
+		MaxUses:    1,
+	}
+}
+
+// IsExpired : true when t is out of its lifetime or has no use left
+func (p ExpirationPolicy) IsExpired(t Ticket, now time.Time) bool {
+	return p.Remaining(t, now) <= 0 || (p.MaxUses > 0 && t.Uses >= p.MaxUses)
+}
+
+// Remaining : time left before t expires
+func (p ExpirationPolicy) Remaining(t Ticket, now time.Time) time.Duration {
+	remaining := time.Duration(1<<63 - 1)
+	if p.TimeToLive > 0 {
+		remaining = t.CreatedAt.Add(p.TimeToLive).Sub(now)
+	}
+	if p.IdleTimeout > 0 {
+		lastUsed := t.LastUsedAt
+		if lastUsed.IsZero() {
+			lastUsed = t.CreatedAt
+		}
+		if idle := lastUsed.Add(p.IdleTimeout).Sub(now); idle < remaining {
+			remaining = idle
+		}
+	}
+	return remaining
+}
+
+// useTicket : record a use of t, returns false once t has no use left
+func useTicket(t *Ticket, now time.Time) bool {
+	t.Uses++
+	t.LastUsedAt = now
+	p := ticketPolicy(*t)
+	return p.MaxUses == 0 || t.Uses < p.MaxUses
+}
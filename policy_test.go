@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpirationPolicy(t *testing.T) {
+	now := time.Now()
+	p := ExpirationPolicy{TimeToLive: time.Hour, IdleTimeout: 10 * time.Minute}
+
+	tgt := Ticket{Class: "TGT", CreatedAt: now.Add(-30 * time.Minute), LastUsedAt: now.Add(-5 * time.Minute)}
+	assert.Equal(t, false, p.IsExpired(tgt, now), "recently used")
+	assert.Equal(t, 5*time.Minute, p.Remaining(tgt, now), "idle timeout is the nearest limit")
+
+	tgt.LastUsedAt = now.Add(-11 * time.Minute)
+	assert.Equal(t, true, p.IsExpired(tgt, now), "idle too long")
+
+	tgt.CreatedAt = now.Add(-61 * time.Minute)
+	tgt.LastUsedAt = now
+	assert.Equal(t, true, p.IsExpired(tgt, now), "hard maximum reached")
+
+	p = ExpirationPolicy{TimeToLive: time.Minute, MaxUses: 2}
+	st := Ticket{Class: "ST", CreatedAt: now}
+	assert.Equal(t, false, p.IsExpired(st, now), "unused ST")
+	st.Uses = 2
+	assert.Equal(t, true, p.IsExpired(st, now), "no use left")
+
+	// default config: single use ST, long term TGT outlives a normal one
+	st = Ticket{Class: "ST", CreatedAt: now}
+	assert.Equal(t, false, useTicket(&st, now), "ST used once")
+	long := ticketPolicy(Ticket{Class: "TGT", LongTerm: true})
+	assert.True(t, long.TimeToLive > ticketPolicy(Ticket{Class: "TGT"}).TimeToLive, "remember me policy")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ulule/limiter"
+	mgin "github.com/ulule/limiter/drivers/middleware/gin"
+	"github.com/ulule/limiter/drivers/store/memory"
+)
+
+/* Rate limiter: per route group and client ip */
+
+// rateLimit : limiter middleware for a route group, formatted as "10-M",
+// an empty rate disables the limiter. Trusted clients are never limited.
+func rateLimit(formatted string, trusted []string) gin.HandlerFunc {
+	if formatted == "" {
+		return func(c *gin.Context) { c.Next() }
+	}
+	rate, err := limiter.NewRateFromFormatted(formatted)
+	if err != nil {
+		panic(err)
+	}
+	middleware := mgin.NewMiddleware(limiter.New(memory.NewStore(), rate),
+		mgin.WithLimitReachedHandler(limitReached))
+	nets := parseNets(trusted)
+
+	return func(c *gin.Context) {
+		// ClientIP is the peer address unless it is one of TrustedProxies
+		if inNets(nets, c.ClientIP()) {
+			c.Next()
+			return
+		}
+		middleware(c)
+	}
+}
+
+// limitReached : 429 with Retry-After from the limiter reset time
+func limitReached(c *gin.Context) {
+	retry := int64(1)
+	if reset, err := strconv.ParseInt(c.Writer.Header().Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		if d := reset - time.Now().Unix(); d > retry {
+			retry = d
+		}
+	}
+	reqLog(c).Info(c.ClientIP(), " - RATE LIMIT [path:", c.Request.URL.Path, "]")
+	metricRateLimited.WithLabelValues(c.FullPath()).Inc()
+	c.Header("Retry-After", strconv.FormatInt(retry, 10))
+	c.String(429, "Limit exceeded")
+}
+
+// parseNets : ip addresses and CIDR blocks, invalid values are logged and skipped
+func parseNets(list []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, v := range list {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v = v + "/32"
+			} else {
+				v = v + "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func inNets(nets []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
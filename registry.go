@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/* Ticket registry: pluggable ticket storage */
+
+var registry TicketRegistry = NewMemoryRegistry()
+
+// ErrTicketNotFound : unknown or already consumed ticket
+var ErrTicketNotFound = errors.New("Ticket not recognized")
+
+// TicketRegistry : ticket storage backend
+type TicketRegistry interface {
+	// Add stores a ticket, replacing any ticket with the same value
+	Add(t Ticket) error
+	// Get returns a copy of the ticket or nil when unknown
+	Get(value string) *Ticket
+	// Consume looks up a ticket, runs check on it and records a use when
+	// check succeeds, in one atomic operation. The ticket is removed when it
+	// has no use left, so a single use ticket is consumed only once. A ST or
+	// PT refused by check is removed too
+	Consume(value string, check func(t *Ticket) error) (*Ticket, error)
+	// Update runs fn on a ticket and stores the result in one atomic
+	// operation, a removed ticket is not written back: ErrTicketNotFound
+	Update(value string, fn func(t *Ticket)) (*Ticket, error)
+	// Delete removes a ticket, unknown values are ignored
+	Delete(value string)
+	// List returns a copy of all tickets
+	List() []Ticket
+	// ListByUser returns a copy of all tickets owned by user
+	ListByUser(user string) []Ticket
+	// Expire removes every ticket for which expired returns true
+	Expire(expired func(t Ticket) bool) int
+	// Ping checks the storage is available
+	Ping() error
+}
+
+// newRegistry : build the registry selected by config
+func newRegistry(config Config) (TicketRegistry, error) {
+	switch config.Registry {
+	case "", "memory":
+		return NewMemoryRegistry(), nil
+	case "bolt":
+		return NewBoltRegistry(config.RegistryPath)
+	case "redis":
+		return NewRedisRegistry(config.RedisAddr, config.RedisPassword, config.RedisDB)
+	}
+	return nil, fmt.Errorf("unknown ticket registry <%s>", config.Registry)
+}
+
+// spentOnFailure : ST and PT are invalidated by any validation attempt,
+// even a failed one (CAS protocol 3.1.1)
+func spentOnFailure(t Ticket) bool {
+	return t.Class == "ST" || t.Class == "PT"
+}
+
+// MemoryRegistry : in memory ticket registry, lost on restart
+type MemoryRegistry struct {
+	mutex   sync.Mutex
+	tickets map[string]Ticket
+}
+
+// NewMemoryRegistry creates an empty in memory registry
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{tickets: map[string]Ticket{}}
+}
+
+func (r *MemoryRegistry) Add(t Ticket) error {
+	r.mutex.Lock()
+	r.tickets[t.Value] = t
+	r.mutex.Unlock()
+	return nil
+}
+
+func (r *MemoryRegistry) Get(value string) *Ticket {
+	r.mutex.Lock()
+	t, ok := r.tickets[value]
+	r.mutex.Unlock()
+	if ok {
+		return &t
+	}
+	return nil
+}
+
+func (r *MemoryRegistry) Consume(value string, check func(t *Ticket) error) (*Ticket, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	t, ok := r.tickets[value]
+	if !ok {
+		return nil, ErrTicketNotFound
+	}
+	if err := check(&t); err != nil {
+		if spentOnFailure(t) {
+			delete(r.tickets, value)
+		}
+		return &t, err
+	}
+	if useTicket(&t, time.Now()) {
+		r.tickets[value] = t
+	} else {
+		delete(r.tickets, value)
+	}
+	return &t, nil
+}
+
+func (r *MemoryRegistry) Update(value string, fn func(t *Ticket)) (*Ticket, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	t, ok := r.tickets[value]
+	if !ok {
+		return nil, ErrTicketNotFound
+	}
+	fn(&t)
+	r.tickets[value] = t
+	return &t, nil
+}
+
+func (r *MemoryRegistry) Delete(value string) {
+	r.mutex.Lock()
+	delete(r.tickets, value)
+	r.mutex.Unlock()
+}
+
+func (r *MemoryRegistry) List() []Ticket {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	l := make([]Ticket, 0, len(r.tickets))
+	for _, t := range r.tickets {
+		l = append(l, t)
+	}
+	return l
+}
+
+func (r *MemoryRegistry) ListByUser(user string) []Ticket {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var l []Ticket
+	for _, t := range r.tickets {
+		if t.User == user {
+			l = append(l, t)
+		}
+	}
+	return l
+}
+
+func (r *MemoryRegistry) Ping() error {
+	return nil
+}
+
+func (r *MemoryRegistry) Expire(expired func(t Ticket) bool) int {
+	n := 0
+	r.mutex.Lock()
+	for k, t := range r.tickets {
+		if expired(t) {
+			delete(r.tickets, k)
+			n++
+		}
+	}
+	r.mutex.Unlock()
+	return n
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var ticketBucket = []byte("tickets")
+
+// BoltRegistry : on disk ticket registry, tickets survive a restart
+type BoltRegistry struct {
+	db *bolt.DB
+}
+
+// NewBoltRegistry opens or creates the registry database file
+func NewBoltRegistry(path string) (*BoltRegistry, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(ticketBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltRegistry{db: db}, nil
+}
+
+// Close releases the database file
+func (r *BoltRegistry) Close() error {
+	return r.db.Close()
+}
+
+func (r *BoltRegistry) Add(t Ticket) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(ticketBucket).Put([]byte(t.Value), b)
+	})
+}
+
+func (r *BoltRegistry) Get(value string) *Ticket {
+	var t *Ticket
+	r.db.View(func(tx *bolt.Tx) error {
+		t = decodeTicket(tx.Bucket(ticketBucket).Get([]byte(value)))
+		return nil
+	})
+	return t
+}
+
+func (r *BoltRegistry) Consume(value string, check func(t *Ticket) error) (*Ticket, error) {
+	var t *Ticket
+	var checkErr error
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ticketBucket)
+		t = decodeTicket(b.Get([]byte(value)))
+		if t == nil {
+			return ErrTicketNotFound
+		}
+		// a refused ticket is returned after the commit, an error here
+		// would roll back its removal
+		if checkErr = check(t); checkErr != nil {
+			if spentOnFailure(*t) {
+				return b.Delete([]byte(value))
+			}
+			return nil
+		}
+		if useTicket(t, time.Now()) {
+			v, err := json.Marshal(t)
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(value), v)
+		}
+		return b.Delete([]byte(value))
+	})
+	if err == nil {
+		err = checkErr
+	}
+	return t, err
+}
+
+func (r *BoltRegistry) Update(value string, fn func(t *Ticket)) (*Ticket, error) {
+	var t *Ticket
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ticketBucket)
+		if t = decodeTicket(b.Get([]byte(value))); t == nil {
+			return ErrTicketNotFound
+		}
+		fn(t)
+		v, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(value), v)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (r *BoltRegistry) Delete(value string) {
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(ticketBucket).Delete([]byte(value))
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func (r *BoltRegistry) List() []Ticket {
+	return r.list(func(t Ticket) bool { return true })
+}
+
+func (r *BoltRegistry) ListByUser(user string) []Ticket {
+	return r.list(func(t Ticket) bool { return t.User == user })
+}
+
+func (r *BoltRegistry) list(match func(t Ticket) bool) []Ticket {
+	var l []Ticket
+	r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(ticketBucket).ForEach(func(k, v []byte) error {
+			if t := decodeTicket(v); t != nil && match(*t) {
+				l = append(l, *t)
+			}
+			return nil
+		})
+	})
+	return l
+}
+
+func (r *BoltRegistry) Expire(expired func(t Ticket) bool) int {
+	n := 0
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ticketBucket)
+		var keys [][]byte
+		b.ForEach(func(k, v []byte) error {
+			if t := decodeTicket(v); t == nil || expired(*t) {
+				keys = append(keys, append([]byte{}, k...))
+			}
+			return nil
+		})
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(keys)
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+		return 0
+	}
+	return n
+}
+
+func (r *BoltRegistry) Ping() error {
+	return r.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(ticketBucket) == nil {
+			return bolt.ErrBucketNotFound
+		}
+		return nil
+	})
+}
+
+func decodeTicket(b []byte) *Ticket {
+	if b == nil {
+		return nil
+	}
+	var t Ticket
+	if err := json.Unmarshal(b, &t); err != nil {
+		log.Error(err)
+		return nil
+	}
+	return &t
+}
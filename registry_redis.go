@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+const redisTicketPrefix = "cas:ticket:"
+
+// RedisRegistry : ticket registry shared between several server instances,
+// expiry is delegated to redis key TTL. A key evicted by its TTL is gone
+// without notice, no session_expired event is sent for it
+type RedisRegistry struct {
+	client *redis.Client
+}
+
+// NewRedisRegistry connects to the redis server
+func NewRedisRegistry(addr string, password string, db int) (*RedisRegistry, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: password,
+		DB:       db,
+	})
+	if err := client.Ping().Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &RedisRegistry{client: client}, nil
+}
+
+// Close closes the redis connection
+func (r *RedisRegistry) Close() error {
+	return r.client.Close()
+}
+
+func (r *RedisRegistry) Add(t Ticket) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(redisTicketPrefix+t.Value, b, redisTTL(t)).Err()
+}
+
+// redisTTL : key TTL from the ticket expiration policy
+func redisTTL(t Ticket) time.Duration {
+	ttl := ticketPolicy(t).Remaining(t, time.Now())
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	return ttl
+}
+
+func (r *RedisRegistry) Get(value string) *Ticket {
+	b, err := r.client.Get(redisTicketPrefix + value).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			log.Error(err)
+		}
+		return nil
+	}
+	return decodeTicket(b)
+}
+
+func (r *RedisRegistry) Consume(value string, check func(t *Ticket) error) (*Ticket, error) {
+	key := redisTicketPrefix + value
+	var t *Ticket
+	consume := func(tx *redis.Tx) error {
+		b, err := tx.Get(key).Bytes()
+		if err != nil {
+			return err
+		}
+		if t = decodeTicket(b); t == nil {
+			return ErrTicketNotFound
+		}
+		if err := check(t); err != nil {
+			if spentOnFailure(*t) {
+				if _, derr := tx.TxPipelined(func(pipe redis.Pipeliner) error {
+					pipe.Del(key)
+					return nil
+				}); derr != nil {
+					return derr
+				}
+			}
+			return err
+		}
+		keep := useTicket(t, time.Now())
+		v, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			if keep {
+				pipe.Set(key, v, redisTTL(*t))
+			} else {
+				pipe.Del(key)
+			}
+			return nil
+		})
+		return err
+	}
+	// another consumer used the ticket meanwhile: try again on the current
+	// one, with uses left it is still valid, a consumed one is gone
+	var err error = redis.TxFailedErr
+	for i := 0; i < 10 && err == redis.TxFailedErr; i++ {
+		err = r.client.Watch(consume, key)
+	}
+	if err == redis.Nil {
+		return nil, ErrTicketNotFound
+	}
+	return t, err
+}
+
+func (r *RedisRegistry) Update(value string, fn func(t *Ticket)) (*Ticket, error) {
+	key := redisTicketPrefix + value
+	var t *Ticket
+	update := func(tx *redis.Tx) error {
+		b, err := tx.Get(key).Bytes()
+		if err != nil {
+			return err
+		}
+		if t = decodeTicket(b); t == nil {
+			return ErrTicketNotFound
+		}
+		fn(t)
+		v, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.Set(key, v, redisTTL(*t))
+			return nil
+		})
+		return err
+	}
+	// the ticket changed meanwhile: try again on the current one
+	var err error = redis.TxFailedErr
+	for i := 0; i < 10 && err == redis.TxFailedErr; i++ {
+		err = r.client.Watch(update, key)
+	}
+	switch err {
+	case nil:
+		return t, nil
+	case redis.Nil:
+		return nil, ErrTicketNotFound
+	}
+	return nil, err
+}
+
+func (r *RedisRegistry) Delete(value string) {
+	if err := r.client.Del(redisTicketPrefix + value).Err(); err != nil {
+		log.Error(err)
+	}
+}
+
+func (r *RedisRegistry) List() []Ticket {
+	return r.list(func(t Ticket) bool { return true })
+}
+
+func (r *RedisRegistry) ListByUser(user string) []Ticket {
+	return r.list(func(t Ticket) bool { return t.User == user })
+}
+
+func (r *RedisRegistry) list(match func(t Ticket) bool) []Ticket {
+	var l []Ticket
+	iter := r.client.Scan(0, redisTicketPrefix+"*", 100).Iterator()
+	for iter.Next() {
+		b, err := r.client.Get(iter.Val()).Bytes()
+		if err != nil {
+			continue
+		}
+		if t := decodeTicket(b); t != nil && match(*t) {
+			l = append(l, *t)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		log.Error(err)
+	}
+	return l
+}
+
+func (r *RedisRegistry) Expire(expired func(t Ticket) bool) int {
+	n := 0
+	for _, t := range r.List() {
+		if expired(t) {
+			if r.client.Del(redisTicketPrefix+t.Value).Val() > 0 {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func (r *RedisRegistry) Ping() error {
+	return r.client.Ping().Err()
+}
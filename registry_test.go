@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryRegistry(t *testing.T) {
+	r := NewMemoryRegistry()
+	r.Add(Ticket{Class: "TGT", Value: "TGT-1", User: "user1", CreatedAt: time.Now()})
+	r.Add(Ticket{Class: "ST", Value: "ST-1", User: "user1", Service: "http://s/", CreatedAt: time.Now()})
+	r.Add(Ticket{Class: "ST", Value: "ST-2", User: "user2", CreatedAt: time.Now().Add(-time.Hour)})
+
+	assert.Equal(t, "user1", r.Get("TGT-1").User, "get ticket")
+	assert.Nil(t, r.Get("TGT-0"), "unknown ticket")
+	assert.Equal(t, 3, len(r.List()), "list all tickets")
+	assert.Equal(t, 2, len(r.ListByUser("user1")), "list by user")
+
+	testConsume(t, r)
+
+	old := time.Now().Add(-time.Minute)
+	n := r.Expire(func(v Ticket) bool { return v.CreatedAt.Before(old) })
+	assert.Equal(t, 1, n, "expire old ticket")
+	assert.Nil(t, r.Get("ST-2"), "expired ticket removed")
+
+	r.Delete("TGT-1")
+	assert.Equal(t, 0, len(r.List()), "empty registry")
+}
+
+func TestBoltRegistry(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "castest")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tickets.db")
+
+	r, err := NewBoltRegistry(path)
+	assert.Nil(t, err, "open registry")
+	r.Add(Ticket{Class: "TGT", Value: "TGT-1", User: "user1", CreatedAt: time.Now()})
+	r.Add(Ticket{Class: "ST", Value: "ST-1", User: "user1", Service: "http://s/", CreatedAt: time.Now()})
+	r.Close()
+
+	// reopen: tickets survive a restart
+	r, err = NewBoltRegistry(path)
+	assert.Nil(t, err, "reopen registry")
+	defer r.Close()
+	assert.Equal(t, 2, len(r.ListByUser("user1")), "tickets reloaded")
+
+	testConsume(t, r)
+
+	n := r.Expire(func(v Ticket) bool { return v.Class == "TGT" })
+	assert.Equal(t, 1, n, "expire TGT")
+	assert.Equal(t, 0, len(r.List()), "empty registry")
+}
+
+func TestRedisRegistry(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.Nil(t, err, "start redis stand-in")
+	defer mr.Close()
+
+	r, err := NewRedisRegistry(mr.Addr(), "", 0)
+	assert.Nil(t, err, "connect registry")
+	defer r.Close()
+	r.Add(Ticket{Class: "TGT", Value: "TGT-1", User: "user1", CreatedAt: time.Now()})
+	r.Add(Ticket{Class: "ST", Value: "ST-1", User: "user1", Service: "http://s/", CreatedAt: time.Now()})
+	r.Add(Ticket{Class: "ST", Value: "ST-2", User: "user2", CreatedAt: time.Now()})
+
+	assert.Equal(t, "user1", r.Get("TGT-1").User, "get ticket")
+	assert.Equal(t, 2, len(r.ListByUser("user1")), "list by user")
+
+	testConsume(t, r)
+
+	// ST expire through key TTL, TGT is still valid
+	mr.FastForward(ticketPolicy(Ticket{Class: "ST"}).TimeToLive + time.Second)
+	assert.Nil(t, r.Get("ST-2"), "ST expired by TTL")
+	assert.NotNil(t, r.Get("TGT-1"), "TGT still valid")
+
+	r.Delete("TGT-1")
+	assert.Equal(t, 0, len(r.List()), "empty registry")
+}
+
+// testConsume : a ST refused by check is removed, a refused TGT is kept, a
+// removed ticket is not updated, an accepted ticket is consumed only once
+// even with concurrent consumers, which all get the uses left
+func testConsume(t *testing.T, r TicketRegistry) {
+	errCheck := errors.New("bad service")
+	check := func(v *Ticket) error {
+		if v.Service != "http://s/" {
+			return errCheck
+		}
+		return nil
+	}
+	r.Add(Ticket{Class: "ST", Value: "ST-C", User: "user1", Service: "http://other/", CreatedAt: time.Now()})
+	_, err := r.Consume("ST-C", check)
+	assert.Equal(t, errCheck, err, "check refuse ticket")
+	assert.Nil(t, r.Get("ST-C"), "refused ST is removed")
+	_, err = r.Consume("ST-C", check)
+	assert.Equal(t, ErrTicketNotFound, err, "refused ST can't be replayed")
+
+	r.Add(Ticket{Class: "TGT", Value: "TGT-C", User: "user1", Service: "http://other/", CreatedAt: time.Now()})
+	_, err = r.Consume("TGT-C", check)
+	assert.Equal(t, errCheck, err, "check refuse TGT")
+	assert.NotNil(t, r.Get("TGT-C"), "refused TGT is kept")
+	r.Delete("TGT-C")
+
+	r.Add(Ticket{Class: "TGT", Value: "TGT-U", User: "user1", CreatedAt: time.Now()})
+	u, err := r.Update("TGT-U", func(v *Ticket) { v.Uses++ })
+	assert.Nil(t, err, "update ticket")
+	assert.Equal(t, 1, u.Uses, "updated copy")
+	assert.Equal(t, 1, r.Get("TGT-U").Uses, "update stored")
+	r.Delete("TGT-U")
+	_, err = r.Update("TGT-U", func(v *Ticket) { v.Uses++ })
+	assert.Equal(t, ErrTicketNotFound, err, "removed ticket")
+	assert.Nil(t, r.Get("TGT-U"), "removed ticket not written back")
+
+	var wg sync.WaitGroup
+	var won int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if st, err := r.Consume("ST-1", check); err == nil && st.Service == "http://s/" {
+				atomic.AddInt32(&won, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), won, "only one consumer wins")
+	_, err = r.Consume("ST-1", check)
+	assert.Equal(t, ErrTicketNotFound, err, "ticket consumed only once")
+
+	// concurrent consumers of a multi use ticket all win while uses are left
+	saved := *currentConfig()
+	defer setConfig(saved)
+	multi := saved
+	multi.STmaxUses = 5
+	setConfig(multi)
+	r.Add(Ticket{Class: "ST", Value: "ST-M", User: "user1", Service: "http://s/", CreatedAt: time.Now()})
+	won = 0
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := r.Consume("ST-M", check); err == nil {
+				atomic.AddInt32(&won, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(5), won, "every use left is granted")
+	_, err = r.Consume("ST-M", check)
+	assert.Equal(t, ErrTicketNotFound, err, "no use left")
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* Config reload: SIGHUP or POST /reload, the ticket registry is kept */
+
+var (
+	// runningConfig : *Config in use, never modified once stored. A request
+	// loads it once, a reload stores a new one
+	runningConfig atomic.Value
+	// reloadMutex : one reload or key rotation at a time
+	reloadMutex sync.Mutex
+)
+
+// currentConfig : the running config, read only
+func currentConfig() *Config {
+	return runningConfig.Load().(*Config)
+}
+
+// setConfig : make c the running config
+func setConfig(c Config) {
+	runningConfig.Store(&c)
+}
+
+// loadConfig : defaults, config file, environment and flags, validated.
+// Missing cookie keys are generated at startup only
+func loadConfig(startup bool) (Config, error) {
+	c := defaultConfig
+	if *conf != "" {
+		var err error
+		if c, err = readConf(c, *conf); err != nil {
+			return c, err
+		}
+	}
+	c, err := readEnv(c)
+	if err != nil {
+		return c, err
+	}
+	if c, err = readSecrets(c, startup); err != nil {
+		return c, err
+	}
+	c = confFlags(c)
+	return c, validateConfig(c)
+}
+
+// reloadConfig : read the config again and swap it in when valid, the
+// caller holds reloadMutex. Registry, listener, rate limits and tracing are
+// applied on restart.
+func reloadConfig() error {
+	c, err := loadConfig(false)
+	if err != nil {
+		return err
+	}
+
+	old := *currentConfig()
+	setConfig(c)
+	confSecrets(c)
+	if old.LogPath != c.LogPath || old.LogFormat != c.LogFormat || old.LogLevel != c.LogLevel || old.Debug != c.Debug {
+		confLog(c.LogPath, c.LogFormat, c.LogLevel, c.Debug)
+	}
+	if old.AuditLogPath != c.AuditLogPath {
+		confAudit(c.AuditLogPath)
+	}
+	if !reflect.DeepEqual(webhooksConfig(old), webhooksConfig(c)) {
+		w := NewWebhooks(c)
+		if w != nil {
+			w.Start()
+		}
+		if running := currentWebhooks(); running != nil {
+			running.Stop()
+		}
+		setWebhooks(w)
+	}
+
+	restart := map[string]bool{
+		"registry":    old.Registry != c.Registry || old.RegistryPath != c.RegistryPath || old.RedisAddr != c.RedisAddr || old.RedisDB != c.RedisDB,
+		"listener":    old.Port != c.Port || old.BasePath != c.BasePath || !reflect.DeepEqual(old.TrustedProxies, c.TrustedProxies) || old.TLSCert != c.TLSCert || old.TLSKey != c.TLSKey || old.TLSMinVersion != c.TLSMinVersion || !reflect.DeepEqual(old.TLSCiphers, c.TLSCiphers) || old.TLSRedirectPort != c.TLSRedirectPort || old.TLSSelfSigned != c.TLSSelfSigned,
+		"rate limits": old.RateLogin != c.RateLogin || old.RateValidate != c.RateValidate || old.RateAdmin != c.RateAdmin || !reflect.DeepEqual(old.RateTrusted, c.RateTrusted),
+		"tracing":     old.TraceExporter != c.TraceExporter || old.TraceEndpoint != c.TraceEndpoint || old.TraceInsecure != c.TraceInsecure,
+	}
+	for name, changed := range restart {
+		if changed {
+			log.Warn("config reload: ", name, " changed, applied on restart")
+		}
+	}
+	log.Info("config reloaded")
+	return nil
+}
+
+// webhooksConfig : the webhook options of c
+func webhooksConfig(c Config) []interface{} {
+	return []interface{}{c.WebhookURLs, c.WebhookSecret, c.WebhookEvents, c.WebhookQueueSize, c.WebhookRetries}
+}
+
+// reloadLock : one reload or key rotation at a time, after adminAuth so
+// unauthenticated callers can't hold it
+func reloadLock() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		reloadMutex.Lock()
+		defer reloadMutex.Unlock()
+		c.Next()
+	}
+}
+
+// watchReload : reload the config on SIGHUP
+func watchReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadMutex.Lock()
+			if err := reloadConfig(); err != nil {
+				log.Error("config reload refused: ", err)
+			}
+			reloadMutex.Unlock()
+		}
+	}()
+}
+
+// curl -X POST -H "SharedKey: secret4" http://localhost:8001/reload
+func reloadStatus(c *gin.Context) {
+	c.Header("Content-Type", "text/plain")
+	if err := reloadConfig(); err != nil {
+		reqLog(c).Error(c.ClientIP(), " - Admin ", c.GetString("admin"), ": config reload refused: ", err)
+		c.String(400, "%s\n", err)
+		return
+	}
+	reqLog(c).Info(c.ClientIP(), " - Admin ", c.GetString("admin"), ": config reloaded")
+	c.String(200, "config reloaded\n")
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/securecookie"
+	gsessions "github.com/gorilla/sessions"
+	"gopkg.in/ini.v1"
+)
+
+/* Cookie secrets: applied after config load, generated on first run,
+rotated with the previous keys still accepted */
+
+var (
+	// tgcCodecs : []securecookie.Codec of the TGC cookie, swapped by
+	// confSecrets
+	tgcCodecs atomic.Value
+	// cookieStore : session cookie store, same key rotation
+	cookieStore = &sessionStore{}
+)
+
+// codecs : TGC cookie codecs, the first encodes and all decode
+func codecs() []securecookie.Codec {
+	return tgcCodecs.Load().([]securecookie.Codec)
+}
+
+// sessionStore : cookie session store whose keys are set by confSecrets,
+// a key change swaps the whole gorilla store while requests use it
+type sessionStore struct {
+	mutex   sync.Mutex
+	keys    [][]byte
+	options *gsessions.Options
+	current atomic.Value
+}
+
+// Options : sessions.Store options
+func (s *sessionStore) Options(options sessions.Options) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.options = options.ToGorillaOptions()
+	s.swap()
+}
+
+// setKeys : key pairs of the session cookie
+func (s *sessionStore) setKeys(keys [][]byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys = keys
+	s.swap()
+}
+
+// swap : new gorilla store of keys and options, the caller holds mutex
+func (s *sessionStore) swap() {
+	store := gsessions.NewCookieStore(s.keys...)
+	if s.options != nil {
+		store.Options = s.options
+	}
+	s.current.Store(store)
+}
+
+func (s *sessionStore) store() *gsessions.CookieStore {
+	return s.current.Load().(*gsessions.CookieStore)
+}
+
+// Get : gsessions.Store
+func (s *sessionStore) Get(r *http.Request, name string) (*gsessions.Session, error) {
+	return s.store().Get(r, name)
+}
+
+// New : gsessions.Store
+func (s *sessionStore) New(r *http.Request, name string) (*gsessions.Session, error) {
+	return s.store().New(r, name)
+}
+
+// Save : gsessions.Store
+func (s *sessionStore) Save(r *http.Request, w http.ResponseWriter, session *gsessions.Session) error {
+	return s.store().Save(r, w, session)
+}
+
+// confSecrets : cookie keys of config, for the TGC and the session cookie.
+// Cookies signed with the previous keys are still accepted.
+func confSecrets(config Config) {
+	tgc := [][]byte{[]byte(config.HashSecret), []byte(config.Secret)}
+	session := [][]byte{[]byte(config.Secret), nil}
+	for i, s := range config.PreviousSecrets {
+		tgc = append(tgc, []byte(config.PreviousHashSecrets[i]), []byte(s))
+		session = append(session, []byte(s), nil)
+	}
+	tgcCodecs.Store(tgcCodecsOf(config, tgc))
+	cookieStore.setKeys(session)
+}
+
+// tgcCodecsOf : codecs of the TGC key pairs, whose timestamps are accepted
+// as long as the longest TGT lives. The securecookie default of 30 days
+// would refuse a remember me cookie the browser still sends
+func tgcCodecsOf(config Config, pairs [][]byte) []securecookie.Codec {
+	hours := config.TGCvalidPeriod
+	if config.RememberMeValidPeriod > hours {
+		hours = config.RememberMeValidPeriod
+	}
+	codecs := securecookie.CodecsFromPairs(pairs...)
+	for _, c := range codecs {
+		if sc, ok := c.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(hours * 3600)
+		}
+	}
+	return codecs
+}
+
+// readSecrets : Secret and HashSecret from config.SecretsFile, random keys
+// are generated and written to it on first run. A reload doesn't generate:
+// new keys would log every user out
+func readSecrets(config Config, generate bool) (Config, error) {
+	file := config.SecretsFile
+	if file == "" {
+		return config, nil
+	}
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		if !generate {
+			return config, fmt.Errorf("SecretsFile <%s> not found, keys are generated at startup only", file)
+		}
+		config.Secret = randomKey(32)
+		config.HashSecret = randomKey(64)
+		config.PreviousSecrets = nil
+		config.PreviousHashSecrets = nil
+		if err := writeSecrets(config); err != nil {
+			return config, err
+		}
+		log.Info("cookie secrets generated in ", file)
+		return config, nil
+	}
+	cfg, err := ini.Load(file)
+	if err != nil {
+		return config, err
+	}
+	keys := cfg.Section("")
+	config.Secret = keys.Key("Secret").String()
+	config.HashSecret = keys.Key("HashSecret").String()
+	config.PreviousSecrets = keys.Key("PreviousSecrets").Strings(",")
+	config.PreviousHashSecrets = keys.Key("PreviousHashSecrets").Strings(",")
+	return config, nil
+}
+
+// writeSecrets : keys of config to config.SecretsFile, readable by owner only
+func writeSecrets(config Config) error {
+	content := fmt.Sprintf("Secret = %s\nHashSecret = %s\nPreviousSecrets = %s\nPreviousHashSecrets = %s\n",
+		config.Secret, config.HashSecret,
+		strings.Join(config.PreviousSecrets, ", "), strings.Join(config.PreviousHashSecrets, ", "))
+	return ioutil.WriteFile(config.SecretsFile, []byte(content), 0600)
+}
+
+// rotateSecrets : new keys in config.SecretsFile, the current keys become
+// the first previous ones, SecretsKeep previous keys are kept
+func rotateSecrets(config Config) (Config, error) {
+	if config.SecretsFile == "" {
+		return config, fmt.Errorf("key rotation needs SecretsFile")
+	}
+	keep := config.SecretsKeep
+	config.PreviousSecrets = append([]string{config.Secret}, config.PreviousSecrets...)
+	config.PreviousHashSecrets = append([]string{config.HashSecret}, config.PreviousHashSecrets...)
+	if len(config.PreviousSecrets) > keep {
+		config.PreviousSecrets = config.PreviousSecrets[:keep]
+		config.PreviousHashSecrets = config.PreviousHashSecrets[:keep]
+	}
+	config.Secret = randomKey(32)
+	config.HashSecret = randomKey(64)
+	return config, writeSecrets(config)
+}
+
+// curl -X POST -H "SharedKey: secret4" http://localhost:8001/keys/rotate
+func rotateKeys(c *gin.Context) {
+	c.Header("Content-Type", "text/plain")
+	rotated, err := rotateSecrets(*currentConfig())
+	if err == nil {
+		setConfig(rotated)
+		confSecrets(rotated)
+	}
+	if err != nil {
+		reqLog(c).Error(c.ClientIP(), " - Admin ", c.GetString("admin"), ": key rotation failed: ", err)
+		c.String(400, "%s\n", err)
+		return
+	}
+	reqLog(c).Info(c.ClientIP(), " - Admin ", c.GetString("admin"), ": cookie keys rotated")
+	c.String(200, "cookie keys rotated, %d previous keys accepted\n", len(rotated.PreviousSecrets))
+}
+
+// randomKey : n random letters and digits from crypto/rand
+func randomKey(n int) string {
+	const chars = letterBytes + "0123456789"
+	b := make([]byte, n)
+	for i := range b {
+		r, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+		if err != nil {
+			panic(err)
+		}
+		b[i] = chars[r.Int64()]
+	}
+	return string(b)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+/* TLS: native https listener, certificate reload, http redirect */
+
+// tls versions accepted by TLSMinVersion
+var tlsVersions = map[string]uint16{
+	"":    tls.VersionTLS12,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsEnabled : https listener configured
+func tlsEnabled(config Config) bool {
+	return config.TLSCert != "" || config.TLSSelfSigned
+}
+
+// CertReloader : certificate of the cert and key files, loaded again when
+// one of them changes
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+// NewCertReloader : load the certificate files
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	return r, r.Reload()
+}
+
+// modified : latest modification time of the files
+func (r *CertReloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Reload : load the files if they changed since the last load, a bad
+// certificate keeps the current one
+func (r *CertReloader) Reload() error {
+	modTime, err := r.modified()
+	if err != nil {
+		return err
+	}
+	r.mutex.RLock()
+	unchanged := r.cert != nil && modTime.Equal(r.modTime)
+	r.mutex.RUnlock()
+	if unchanged {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mutex.Unlock()
+	log.Info("TLS certificate loaded from ", r.certFile)
+	return nil
+}
+
+// Watch : check the files every interval
+func (r *CertReloader) Watch(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := r.Reload(); err != nil {
+				log.Error("TLS certificate reload: ", err)
+			}
+		}
+	}()
+}
+
+// GetCertificate : tls.Config callback
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.cert, nil
+}
+
+// selfSignedCert : certificate for localhost, for development
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "localhost", Organization: []string{"castestserver development"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// tlsCiphers : cipher suite ids of names, ie. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+// TLS 1.3 suites are refused, Go ignores them in CipherSuites
+func tlsCiphers(names []string) ([]uint16, error) {
+	known := map[string]uint16{}
+	tls13 := map[string]bool{}
+	for _, c := range tls.CipherSuites() {
+		known[c.Name] = c.ID
+		tls13[c.Name] = len(c.SupportedVersions) == 1 && c.SupportedVersions[0] == tls.VersionTLS13
+	}
+	var ids []uint16
+	for _, n := range names {
+		id, ok := known[n]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure TLS cipher <%s>", n)
+		}
+		if tls13[n] {
+			return nil, fmt.Errorf("TLS cipher <%s> is a TLS 1.3 suite, they are not configurable", n)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// newTLSConfig : tls.Config of config, certificates from the files, reloaded
+// when they change, or self signed
+func newTLSConfig(config Config) (*tls.Config, error) {
+	ciphers, err := tlsCiphers(config.TLSCiphers)
+	if err != nil {
+		return nil, err
+	}
+	t := &tls.Config{
+		MinVersion:   tlsVersions[config.TLSMinVersion],
+		CipherSuites: ciphers,
+	}
+	if config.TLSCert == "" {
+		cert, err := selfSignedCert()
+		if err != nil {
+			return nil, err
+		}
+		log.Warn("TLS with a self signed certificate, for development only")
+		t.Certificates = []tls.Certificate{cert}
+		return t, nil
+	}
+	certs, err := NewCertReloader(config.TLSCert, config.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	certs.Watch(time.Minute)
+	t.GetCertificate = certs.GetCertificate
+	return t, nil
+}
+
+// redirectHTTPS : redirect to the https listener on port
+func redirectHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// newServer : http.Server with timeouts, slow clients can't hold
+// connections open
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+}
+
+// serve : https when TLS is configured, with the optional http redirect
+// listener, plain http otherwise. Startup fails when a port can't be bound
+func serve(handler http.Handler, config Config) error {
+	if !tlsEnabled(config) {
+		return newServer(":"+*port, handler).ListenAndServe()
+	}
+	t, err := newTLSConfig(config)
+	if err != nil {
+		return err
+	}
+	if config.TLSRedirectPort != "" {
+		redirect := newServer(":"+config.TLSRedirectPort, redirectHTTPS(*port))
+		l, err := net.Listen("tcp", redirect.Addr)
+		if err != nil {
+			return err
+		}
+		go func() {
+			log.Error(redirect.Serve(l))
+		}()
+	}
+	server := newServer(":"+*port, handler)
+	server.TLSConfig = t
+	return server.ListenAndServeTLS("", "")
+}
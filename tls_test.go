@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCert : self signed certificate and key files in dir
+func writeCert(t *testing.T, dir string) {
+	cert, err := selfSignedCert()
+	assert.Nil(t, err)
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600))
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "castls")
+	defer os.RemoveAll(dir)
+	writeCert(t, dir)
+
+	r, err := NewCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	assert.Nil(t, err)
+	first, _ := r.GetCertificate(nil)
+	assert.NotNil(t, first)
+
+	assert.Nil(t, r.Reload(), "unchanged files")
+	same, _ := r.GetCertificate(nil)
+	assert.Equal(t, first, same, "not loaded again")
+
+	writeCert(t, dir)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "cert.pem"), later, later)
+	assert.Nil(t, r.Reload())
+	renewed, _ := r.GetCertificate(nil)
+	assert.NotEqual(t, first.Certificate[0], renewed.Certificate[0], "new certificate")
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "key.pem"), []byte("broken"), 0600))
+	later = later.Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "key.pem"), later, later)
+	assert.NotNil(t, r.Reload(), "bad key")
+	kept, _ := r.GetCertificate(nil)
+	assert.Equal(t, renewed, kept, "current certificate kept")
+}
+
+func TestTLSConfig(t *testing.T) {
+	c := *currentConfig()
+	c.TLSSelfSigned = true
+	c.TLSMinVersion = "1.3"
+	tc, err := newTLSConfig(c)
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), tc.MinVersion)
+	assert.Equal(t, 1, len(tc.Certificates), "self signed certificate")
+
+	c.TLSCiphers = []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_RSA_WITH_RC4_128_SHA"}
+	_, err = newTLSConfig(c)
+	assert.NotNil(t, err, "insecure cipher refused")
+	c.TLSCiphers = []string{"TLS_AES_128_GCM_SHA256"}
+	_, err = newTLSConfig(c)
+	assert.NotNil(t, err, "TLS 1.3 suite refused")
+	assert.Contains(t, err.Error(), "TLS 1.3")
+
+	// the redirect port is taken: startup fails
+	busy, err := net.Listen("tcp", ":0")
+	assert.Nil(t, err)
+	defer busy.Close()
+	_, taken, _ := net.SplitHostPort(busy.Addr().String())
+	c.TLSCiphers = nil
+	c.TLSRedirectPort = taken
+	assert.NotNil(t, serve(http.NotFoundHandler(), c), "redirect listener bind failure")
+
+	c = *currentConfig()
+	c.TLSCert = "cert.pem"
+	c.TLSMinVersion = "1.0"
+	c.TLSRedirectPort = "80"
+	err = validateConfig(c)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "TLSKey: both are required")
+	assert.Contains(t, err.Error(), "TLSMinVersion <1.0>")
+}
+
+func TestTLSServer(t *testing.T) {
+	c := *currentConfig()
+	c.TLSSelfSigned = true
+	tc, err := newTLSConfig(c)
+	assert.Nil(t, err)
+	srv := httptest.NewUnstartedServer(setupServer())
+	srv.TLS = tc
+	srv.StartTLS()
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get(srv.URL + "/health")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode, "https listener")
+	assert.Equal(t, "localhost", resp.TLS.PeerCertificates[0].Subject.CommonName, "self signed certificate")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://cas.example.org/login?service=x", nil)
+	redirectHTTPS("3443").ServeHTTP(w, req)
+	assert.Equal(t, http.StatusPermanentRedirect, w.Code)
+	assert.Equal(t, "https://cas.example.org:3443/login?service=x", w.Header().Get("Location"), "http redirect")
+}
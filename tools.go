@@ -2,8 +2,12 @@ package main
 
 import (
 	"encoding/json"
-	"io"
+	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -38,52 +42,49 @@ func StrToStatus(str string) Status {
 	return r
 }
 
-// userFailLimiter : count and manage post requests
-func userFailLimiter(s Status, timeLimit int64) Status {
-	//var timeLimit int64 = 30
-	now := time.Now().UTC().Unix()
-	ret := s
-	ret.LastSeen = now
-	if s.Lock {
-		if now-s.LastSeen > timeLimit {
-			ret.Lock = false
-			ret.Count = 1
-		}
-	} else {
-		ret.Count++
-		if now-s.LastSeen > timeLimit {
-			ret.Count = 1
-		}
-		if ret.Count > 3 {
-			ret.Lock = true
-			ret.Count = 0
-		}
-	}
-	return ret
-}
-
 /* Log management */
 
-var log = logrus.New()
+var (
+	logFormat    = newSwapFormatter(&logrus.TextFormatter{})
+	accessFormat = newSwapFormatter(&logrus.TextFormatter{})
+	log          = newLogger(logFormat)
+	accessLog    = newLogger(accessFormat)
+)
+
+func newLogger(f logrus.Formatter) *logrus.Logger {
+	l := logrus.New()
+	l.Formatter = f
+	return l
+}
 
-func confLog(path string) {
+// confLog : app and access loggers, format "text" (default) or "json", level
+// of app logs "debug", "info" (default), "warn" or "error". The loggers are
+// changed in place, a reload doesn't race with goroutines using them
+func confLog(path string, format string, lvl string, debug bool) {
 	level := logrus.InfoLevel
-	if *debug {
+	if debug {
 		level = logrus.DebugLevel
-	} else {
-		gin.SetMode(gin.ReleaseMode)
 	}
+	if l, err := logrus.ParseLevel(lvl); err == nil && lvl != "" {
+		level = l
+	}
+	log.SetLevel(level)
 
-	log = &logrus.Logger{
-		Out:   os.Stderr,
-		Level: level,
-		Formatter: &easy.Formatter{
+	if format == "json" {
+		logFormat.set(&logrus.JSONFormatter{TimestampFormat: time.RFC3339})
+		accessFormat.set(&logrus.JSONFormatter{TimestampFormat: time.RFC3339})
+	} else {
+		logFormat.set(&textFormatter{easy.Formatter{
 			TimestampFormat: time.RFC3339,
 			LogFormat:       "%lvl% - [%time%] %msg%\n",
-		},
+		}})
+		accessFormat.set(&easy.Formatter{
+			TimestampFormat: time.RFC3339,
+			LogFormat:       "%client_ip% - [%time%] \"%method% %path% %proto%\" %status% \"%user_agent%\" %error% %request_id%\n",
+		})
 	}
 
-	if path != "" && *debug == false {
+	if path != "" && debug == false {
 		writer, _ := rotatelogs.New(
 			path+".%Y%m%d%H%M",
 			rotatelogs.WithLinkName(path),
@@ -91,7 +92,104 @@ func confLog(path string) {
 			rotatelogs.WithRotationTime(time.Duration(24)*time.Hour),
 		)
 		log.SetOutput(writer)
-		gin.DefaultWriter = io.MultiWriter(writer)
+		accessLog.SetOutput(writer)
+	} else {
+		log.SetOutput(os.Stderr)
+		accessLog.SetOutput(gin.DefaultWriter)
+	}
+}
+
+// swapFormatter : formatter set by confLog, logrus reads the Formatter of
+// a logger without lock
+type swapFormatter struct {
+	current atomic.Value
+}
+
+// formatterBox : one concrete type for swapFormatter.current
+type formatterBox struct {
+	logrus.Formatter
+}
+
+func newSwapFormatter(f logrus.Formatter) *swapFormatter {
+	s := &swapFormatter{}
+	s.set(f)
+	return s
+}
+
+func (s *swapFormatter) set(f logrus.Formatter) {
+	s.current.Store(formatterBox{f})
+}
+
+// Format : logrus.Formatter
+func (s *swapFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	return s.current.Load().(formatterBox).Format(entry)
+}
+
+// textFormatter : text layout, with the request id of request log lines
+type textFormatter struct {
+	easy.Formatter
+}
+
+// Format : append [request_id:<id>] to the message
+func (f *textFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	if id, ok := entry.Data["request_id"].(string); ok && id != "" {
+		e := *entry
+		e.Message = entry.Message + " [request_id:" + id + "]"
+		return f.Formatter.Format(&e)
+	}
+	return f.Formatter.Format(entry)
+}
+
+// reqLog : app log entry with the fields of the request
+func reqLog(c *gin.Context) *logrus.Entry {
+	return log.WithFields(logrus.Fields{
+		"request_id": c.GetString("requestId"),
+		"client_ip":  c.ClientIP(),
+		"method":     c.Request.Method,
+		"path":       c.Request.URL.Path,
+	})
+}
+
+var isRequestID = regexp.MustCompile(`^[a-zA-Z0-9\-_\.:]{1,128}$`).MatchString
+
+// requestID : keep the X-Request-ID of the caller or generate one, echoed in
+// the response
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if isRequestID(id) == false {
+			id = RandString(20)
+		}
+		c.Set("requestId", id)
+		c.Header("X-Request-ID", id)
+		c.Next()
+	}
+}
+
+// errorPage : html error message with the request id, for support
+func errorPage(c *gin.Context, msg string) {
+	c.Header("Content-Type", "text/html")
+	c.String(200, "<html>%s<br><small>Request ID: %s</small></html>", msg, c.GetString("requestId"))
+}
+
+// accessLogger : one access log line per request, the user is set by audit
+func accessLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		accessLog.WithFields(logrus.Fields{
+			"request_id": c.GetString("requestId"),
+			"client_ip":  c.ClientIP(),
+			"method":     c.Request.Method,
+			"path":       c.Request.URL.Path,
+			"proto":      c.Request.Proto,
+			"status":     c.Writer.Status(),
+			"user_agent": c.Request.UserAgent(),
+			"user":       c.GetString("user"),
+			"service":    c.Query("service"),
+			"latency_ms": float64(time.Since(start).Microseconds()) / 1000,
+			"error":      c.Errors.ByType(gin.ErrorTypePrivate).String(),
+		}).Info("access")
 	}
 }
 
@@ -100,21 +198,97 @@ func confLog(path string) {
 // Config struct
 type Config struct {
 	Port           string
+	BasePath       string
+	Backend        string
+	Debug          bool
 	Secret         string
 	HashSecret     string
+	SecretsFile    string
 	LdapServer     string
 	LdapBind       string
 	LogPath        string
+	LogFormat      string
+	LogLevel       string
+	AuditLogPath   string
 	TGCvalidPeriod int
+	TGCidleTimeout int
+	STvalidPeriod  int
+	STmaxUses      int
+	PTvalidPeriod  int
+	PTmaxUses      int
 	AdmStatusRead  []string
 	AdmStatusDel   []string
+	Registry       string
+	RegistryPath   string
+	RedisAddr      string
+	RedisPassword  string
+	RedisDB        int
+
+	// native https listener, TLSSelfSigned for development
+	TLSCert         string
+	TLSKey          string
+	TLSMinVersion   string
+	TLSCiphers      []string
+	TLSRedirectPort string
+	TLSSelfSigned   bool
+
+	// cookie key rotation: previous keys still decode, paired by index
+	PreviousSecrets     []string
+	PreviousHashSecrets []string
+	SecretsKeep         int
+
+	// long term "remember me" TGT
+	RememberMeValidPeriod int
+	RememberMeIdleTimeout int
+
+	// brute force lockout
+	FailMaxUser      int
+	FailMaxIP        int
+	FailWindow       int
+	FailLockDuration int
+	FailLockMax      int
+
+	// rate limits "<limit>-<S|M|H|D>" per client ip, empty to disable
+	RateLogin    string
+	RateValidate string
+	RateAdmin    string
+	RateTrusted  []string
+	// reverse proxies allowed to set X-Forwarded-For, none by default: the
+	// client ip is the peer address
+	TrustedProxies []string
+
+	// webhooks: signed JSON POST of audit events
+	WebhookURLs      []string
+	WebhookSecret    string
+	WebhookEvents    []string
+	WebhookQueueSize int
+	WebhookRetries   int
+
+	// OpenTelemetry tracing: exporter "stdout" or "otlp", empty to disable
+	TraceExporter string
+	TraceEndpoint string
+	TraceInsecure bool
+
+	// named admin keys, [admin.<name>] sections
+	AdminKeys []AdminKey `ini:"-"`
 }
 
 func readConf(config Config, file string) (Config, error) {
 	if _, err := os.Stat(file); err != nil {
 		return config, err
 	}
-	ini.MapTo(&config, file)
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		return readYAMLConf(config, file)
+	}
+	cfg, err := ini.Load(file)
+	if err != nil {
+		return config, err
+	}
+	if err := cfg.StrictMapTo(&config); err != nil {
+		return config, fmt.Errorf("%s: %v", file, err)
+	}
+	config.AdminKeys = readAdminKeys(cfg)
 	return config, nil
 }
 
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/* Tracing: optional OpenTelemetry spans with W3C trace context */
+
+// confTracing : set the global tracer provider for config.TraceExporter,
+// "stdout" or "otlp", spans are no-op when empty. Returns a flush function.
+func confTracing(config Config) (func(), error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.TraceExporter {
+	case "":
+		return func() {}, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "otlp":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.TraceEndpoint)}
+		if config.TraceInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	default:
+		err = fmt.Errorf("unknown trace exporter <%s>", config.TraceExporter)
+	}
+	if err != nil {
+		return func() {}, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String("castestserver"))),
+	)
+	otel.SetTracerProvider(tp)
+	return func() {
+		if err := tp.Shutdown(context.Background()); err != nil {
+			log.Error(err)
+		}
+	}, nil
+}
+
+// traceMiddleware : one server span per request, continuing the trace of
+// the incoming traceparent header
+func traceMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := c.FullPath()
+		if route == "" {
+			route = c.Request.URL.Path
+		}
+		ctx, span := otel.Tracer("castestserver").Start(ctx, c.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethodKey.String(c.Request.Method),
+				semconv.HTTPRouteKey.String(route),
+				semconv.HTTPClientIPKey.String(c.ClientIP()),
+			))
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(c.Writer.Status()))
+		if c.Writer.Status() >= 500 {
+			span.SetStatus(codes.Error, "")
+		}
+	}
+}
+
+// startSpan : child span of the request span, ie. around a backend call or a
+// ticket operation. The context carries the span for nested registry spans
+func startSpan(c *gin.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer("castestserver").Start(c.Request.Context(), name, trace.WithAttributes(attrs...))
+}
+
+// traceRegistry : run a ticket registry operation in a "registry.<op>" span,
+// child of the span of ctx. Unknown tickets and refused validations are not
+// span errors
+func traceRegistry(ctx context.Context, op string, f func() error) error {
+	_, span := otel.Tracer("castestserver").Start(ctx, "registry."+op)
+	defer span.End()
+	err := f()
+	if _, refused := err.(*ValidationError); err != nil && err != ErrTicketNotFound && !refused {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// traceValidateTicket : validateTicket in a "ticket.validate" span
+func traceValidateTicket(c *gin.Context, ticket string, serv string, classes ...string) (*Ticket, *ValidationError) {
+	ctx, span := startSpan(c, "ticket.validate", attribute.String("cas.service", serv))
+	defer span.End()
+	t, err := validateTicket(ctx, ticket, serv, classes...)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Code)
+	}
+	return t, err
+}
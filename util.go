@@ -14,11 +14,19 @@ type CASServiceResponse struct {
 }
 
 type CASAuthenticationSuccess struct {
-	XMLName xml.Name `xml:"cas:authenticationSuccess"`
-	User    CASUser
+	XMLName    xml.Name `xml:"cas:authenticationSuccess"`
+	User       CASUser
+	Attributes *CASAttributes
 //	PgtIou  CASPgtIou `xml:",omitempty"`
 }
 
+// CASAttributes : CASv3 authentication attributes
+type CASAttributes struct {
+	XMLName                                xml.Name `xml:"cas:attributes"`
+	IsFromNewLogin                         bool     `xml:"cas:isFromNewLogin"`
+	LongTermAuthenticationRequestTokenUsed bool     `xml:"cas:longTermAuthenticationRequestTokenUsed"`
+}
+
 type CASAuthenticationFailure struct {
 	XMLName xml.Name `xml:"cas:authenticationFailure"`
 	Code    string   `xml:"code,attr"`
@@ -42,10 +50,11 @@ func NewCASResponse() CASServiceResponse {
 }
 
 //func NewCASSuccessResponse(u string, pgtiou string) []byte {
-func NewCASSuccessResponse(u string) []byte {
+func NewCASSuccessResponse(u string, attributes *CASAttributes) []byte {
 	s := NewCASResponse()
 	s.Success = &CASAuthenticationSuccess{
-		User:   CASUser{User: u},
+		User:       CASUser{User: u},
+		Attributes: attributes,
 //		PgtIou: CASPgtIou{Ticket: pgtiou},
 	}
 	x, _ := xml.Marshal(s)
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* Webhooks: signed JSON POST of audit events */
+
+// events sent when WebhookEvents is empty
+var defaultWebhookEvents = []string{
+	AuditLoginSuccess,
+	AuditLogout,
+	AuditValidated,
+	AuditLockout,
+	AuditSessionExpired,
+}
+
+// Webhooks : one bounded queue and worker per URL, so a slow receiver only
+// delays its own events. A full queue drops events so authentication is
+// never blocked
+type Webhooks struct {
+	targets []*webhookTarget
+	secret  []byte
+	events  []string
+	retries int
+	backoff time.Duration
+	client  *http.Client
+	// mutex : Stop closes the queues once no Send is writing to them
+	mutex  sync.RWMutex
+	closed bool
+}
+
+// webhookTarget : queue of event bodies for one URL
+type webhookTarget struct {
+	url   string
+	queue chan []byte
+}
+
+// runningWebhooks : *Webhooks in use, swapped by a reload
+var runningWebhooks atomic.Value
+
+// currentWebhooks : the running webhooks, nil when disabled
+func currentWebhooks() *Webhooks {
+	w, _ := runningWebhooks.Load().(*Webhooks)
+	return w
+}
+
+// setWebhooks : make w the running webhooks
+func setWebhooks(w *Webhooks) {
+	runningWebhooks.Store(w)
+}
+
+// NewWebhooks : nil when no URL is configured
+func NewWebhooks(config Config) *Webhooks {
+	if len(config.WebhookURLs) == 0 {
+		return nil
+	}
+	events := config.WebhookEvents
+	if len(events) == 0 {
+		events = defaultWebhookEvents
+	}
+	size := config.WebhookQueueSize
+	if size <= 0 {
+		size = 100
+	}
+	w := &Webhooks{
+		secret:  []byte(config.WebhookSecret),
+		events:  events,
+		retries: config.WebhookRetries,
+		backoff: time.Second,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	for _, u := range config.WebhookURLs {
+		w.targets = append(w.targets, &webhookTarget{url: u, queue: make(chan []byte, size)})
+	}
+	return w
+}
+
+// Start : run a worker per URL until its queue is closed
+func (w *Webhooks) Start() {
+	for _, t := range w.targets {
+		go func(t *webhookTarget) {
+			for b := range t.queue {
+				w.post(t.url, b)
+			}
+		}(t)
+	}
+}
+
+// Stop : close the queues, pending events are still sent and later ones
+// dropped
+func (w *Webhooks) Stop() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return
+	}
+	w.closed = true
+	for _, t := range w.targets {
+		close(t.queue)
+	}
+}
+
+// Send : queue an event for every URL without blocking
+func (w *Webhooks) Send(e AuditEvent) {
+	if w == nil || contains(w.events, e.Event) == false {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	if w.closed {
+		return
+	}
+	for _, t := range w.targets {
+		select {
+		case t.queue <- b:
+		default:
+			log.Error("webhook queue full for ", t.url, ", event dropped: ", e.Event)
+		}
+	}
+}
+
+// Sign : X-CAS-Signature header value, HMAC-SHA256 of
+// "<X-CAS-Timestamp>.<body>". The receiver refuses old timestamps so a
+// captured request can't be replayed
+func (w *Webhooks) Sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, w.secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// post : POST body to url, retried with exponential backoff
+func (w *Webhooks) post(url string, body []byte) {
+	wait := w.backoff
+	for i := 0; ; i++ {
+		err := w.postOnce(url, body)
+		if err == nil {
+			return
+		}
+		if i >= w.retries {
+			log.Error("webhook ", url, " failed: ", err)
+			return
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+func (w *Webhooks) postOnce(url string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-CAS-Timestamp", timestamp)
+	req.Header.Set("X-CAS-Signature", w.Sign(timestamp, body))
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}